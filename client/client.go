@@ -2,24 +2,28 @@ package client
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/binary"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/genesis32/loft/util"
 	"github.com/pkg/errors"
 )
 
 type ClientConfiguration struct {
-	ServerAddrAndPort     string
-	SslClientCertFilePath string
+	ServerAddrAndPort       string `yaml:"server,omitempty"`
+	SslClientCertFilePath   string `yaml:"cert,omitempty"`
+	SslIdentityCertFilePath string `yaml:"identity_cert,omitempty"`
+	SslIdentityKeyFilePath  string `yaml:"identity_key,omitempty"`
 }
 
 type Client struct {
@@ -27,192 +31,639 @@ type Client struct {
 	bufferedReader *bufio.Reader
 	bufferedWriter *bufio.Writer
 	theConn        net.Conn
+	version        int32
+	features       uint32
+	logger         *log.Logger
+	progress       ProgressFunc
 }
 
+// LoftClient every call takes a context whose deadline applies to the
+// connection and whose cancellation aborts the call part way through
 type LoftClient interface {
-	Connect() error
-	CreateBucket(int64) (string, error)
-	PutFileInBucket(string, string) (uint32, error)
-	PutBucketInFile(string, string) error
+	Connect(context.Context) error
+	CreateBucket(context.Context, string, int64, time.Duration) (string, error)
+	Upload(context.Context, string, io.Reader, int64) error
+	Download(context.Context, string) (io.ReadCloser, BucketInfo, error)
+	PutFileInBucket(context.Context, string, string) error
+	PutReaderInBucket(context.Context, string, io.Reader, string) error
+	PutBucketInFile(context.Context, string, string, bool, bool) error
+	PutBucketInWriter(context.Context, string, io.Writer, bool) error
+	PutBucketRangeInWriter(context.Context, string, io.Writer, int64, int64) error
+	DeleteBucket(context.Context, string) error
+	ListBuckets(context.Context) ([]BucketInfo, error)
+	StatBucket(context.Context, string) (BucketInfo, error)
+	StartUploadSession(context.Context, string, string) (string, error)
+	ResumeUploadSession(context.Context, string, string) error
+	ExtendBucket(context.Context, string, time.Duration) (time.Time, error)
 }
 
-func NewClient(config ClientConfiguration) LoftClient {
-	newClient := &Client{config: config}
-	return newClient
+// BucketInfo describes a bucket on the server. ExpiresAt is nil for buckets
+// that never expire.
+type BucketInfo struct {
+	Name        string     `json:"name"`
+	Capacity    int64      `json:"capacity"`
+	Size        int64      `json:"size"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ModifiedAt  time.Time  `json:"modified_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Owner       string     `json:"owner,omitempty"`
+	ContentType string     `json:"content_type,omitempty"`
+	Checksum    string     `json:"checksum,omitempty"`
 }
 
-func writeBytesToServer(w *bufio.Writer, byteReader *bufio.Reader) error {
-	bytesWritten, err := byteReader.WriteTo(w)
-	if err != nil {
-		return errors.Wrapf(err, "failed. wrote %d bytes to server.", bytesWritten)
+func newBucketInfo(info util.BucketInfo) BucketInfo {
+	bucketInfo := BucketInfo{
+		Name:       info.UniqueIdentifier,
+		Capacity:   info.Capacity,
+		Size:       info.Size,
+		CreatedAt:  time.Unix(0, info.CreatedAt),
+		ModifiedAt: time.Unix(0, info.ModifiedAt),
 	}
-	log.Printf("Number of bytes written: %d", bytesWritten)
-	return nil
+	if info.ExpiresAt != 0 {
+		expiresAt := time.Unix(0, info.ExpiresAt)
+		bucketInfo.ExpiresAt = &expiresAt
+	}
+	return bucketInfo
 }
 
-func readMessageFromServer(reader *bufio.Reader) ([]byte, error) {
-	var err error
-
-	messageSizeBuffer := make([]byte, 1)
-	_, err = io.ReadFull(reader, messageSizeBuffer)
-	if err != nil {
-		return nil, errors.Wrapf(err, "error retrieving 8 bytes for message size")
+func NewClient(config ClientConfiguration, options ...Option) LoftClient {
+	newClient := &Client{
+		config:   config,
+		logger:   log.New(ioutil.Discard, "", 0),
+		progress: func(string, int64, int64) {},
 	}
-	var messageSize byte
-	err = binary.Read(bytes.NewBuffer(messageSizeBuffer), binary.BigEndian, &messageSize)
-	if err != nil {
-		return nil, errors.Wrapf(err, "error translating message size")
+	for _, option := range options {
+		option(newClient)
 	}
+	return newClient
+}
 
-	log.Printf("message size: %d bytes", messageSize)
-	messageBuffer := make([]byte, messageSize)
-	_, err = io.ReadFull(reader, messageBuffer)
+func readMessageFromServer(reader *bufio.Reader) (interface{}, error) {
+	message, err := util.ReadMessageFromReader(reader)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error reading message")
 	}
-
-	return messageBuffer, nil
+	if errorResponse, ok := message.(util.ErrorResponse); ok {
+		return nil, newServerError(errorResponse.ErrorCode, errorResponse.Message)
+	}
+	return message, nil
 }
 
-func (c *Client) Connect() error {
-	var err error
-	if len(strings.TrimSpace(c.config.SslClientCertFilePath)) > 0 {
-		rootCert, err := ioutil.ReadFile(c.config.SslClientCertFilePath)
-		if err != nil {
-			return errors.Wrap(err, "Client.Connect failed to ReadFile")
+// Connect dials the server and says hello, both within the deadline of ctx
+func (c *Client) Connect(ctx context.Context) (err error) {
+	dialer := &net.Dialer{}
+	if len(strings.TrimSpace(c.config.SslClientCertFilePath)) > 0 || len(strings.TrimSpace(c.config.SslIdentityCertFilePath)) > 0 {
+		tlsConfig := &tls.Config{}
+		if len(strings.TrimSpace(c.config.SslClientCertFilePath)) > 0 {
+			rootCert, err := ioutil.ReadFile(c.config.SslClientCertFilePath)
+			if err != nil {
+				return errors.Wrap(err, "Client.Connect failed to ReadFile")
+			}
+			roots := x509.NewCertPool()
+			ok := roots.AppendCertsFromPEM([]byte(rootCert))
+			if !ok {
+				return errors.New("Client.Connect failed to parse root certificate")
+			}
+			tlsConfig.RootCAs = roots
 		}
-		roots := x509.NewCertPool()
-		ok := roots.AppendCertsFromPEM([]byte(rootCert))
-		if !ok {
-			log.Fatal("failed to parse root certificate")
+		if len(strings.TrimSpace(c.config.SslIdentityCertFilePath)) > 0 {
+			identity, err := tls.LoadX509KeyPair(c.config.SslIdentityCertFilePath, c.config.SslIdentityKeyFilePath)
+			if err != nil {
+				return errors.Wrap(err, "Client.Connect failed to load identity key pair")
+			}
+			tlsConfig.Certificates = []tls.Certificate{identity}
 		}
-		tlsConfig := &tls.Config{RootCAs: roots}
-		c.theConn, err = tls.Dial("tcp", c.config.ServerAddrAndPort, tlsConfig)
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: tlsConfig}
+		c.theConn, err = tlsDialer.DialContext(ctx, "tcp", c.config.ServerAddrAndPort)
 		if err != nil {
 			return errors.Wrapf(err,
-				"Client.Connect failed to dial tls enabled server addr:",
+				"Client.Connect failed to dial tls enabled server addr: %s",
 				c.config.ServerAddrAndPort)
 		}
 	} else {
-		c.theConn, err = net.Dial("tcp", c.config.ServerAddrAndPort)
+		c.theConn, err = dialer.DialContext(ctx, "tcp", c.config.ServerAddrAndPort)
 		if err != nil {
 			return errors.Wrapf(err,
-				"Client.Connect failed to dial plaintext server addr:",
+				"Client.Connect failed to dial plaintext server addr: %s",
 				c.config.ServerAddrAndPort)
 		}
 	}
 	c.bufferedReader = bufio.NewReader(c.theConn)
 	c.bufferedWriter = bufio.NewWriter(c.theConn)
-	return nil
+	defer c.watchContext(ctx)(&err)
+	return c.hello()
 }
 
-func (c *Client) CreateBucket(numBytes int64) (string, error) {
-	bucketGenerateRequest := util.BucketGenerateRequest{Header: util.Header{MessageType: util.BucketGenerateMessageType, Version: 1}, NumBytesInBucket: numBytes}
-	err := util.WriteMessageToWriter(c.bufferedWriter, bucketGenerateRequest)
+// hello advertises the protocol versions and features this client supports
+// and records what the server picked
+func (c *Client) hello() error {
+	hello := util.Hello{
+		Header:     util.Header{MessageType: util.HelloMessageType, Version: util.ProtocolVersion1},
+		MinVersion: util.MinProtocolVersion,
+		MaxVersion: util.MaxProtocolVersion,
+		Features:   util.SupportedFeatures,
+	}
+	err := util.WriteMessageToWriter(c.bufferedWriter, hello)
+	if err != nil {
+		return errors.Wrap(err, "error writing hello to server.")
+	}
+
+	msg, err := readMessageFromServer(c.bufferedReader)
+	if err != nil {
+		return errors.Wrap(err, "error reading hello from server.")
+	}
+	switch v := msg.(type) {
+	case util.HelloAck:
+		if v.ErrorCode != util.ErrorCodeNone {
+			return errors.Wrapf(newServerError(v.ErrorCode, ""), "server does not support protocol versions %d-%d",
+				util.MinProtocolVersion, util.MaxProtocolVersion)
+		}
+		c.version = v.SelectedVersion
+		c.features = v.Features
+		c.logger.Printf("protocol version: %d features: %d", c.version, c.features)
+		return nil
+	}
+	return errors.New("unexpected response to hello")
+}
+
+func (c *Client) header(messageType int32) util.Header {
+	return util.Header{MessageType: messageType, Version: c.version}
+}
+
+// watchContext applies the deadline of ctx to the connection and interrupts
+// any read or write in progress when ctx is cancelled, which leaves the
+// connection unusable. The returned func stops watching, clears the deadline
+// and reports the context in *err if that is what made the call fail.
+func (c *Client) watchContext(ctx context.Context) func(err *error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.theConn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			c.theConn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func(err *error) {
+		close(done)
+		<-stopped
+		c.theConn.SetDeadline(time.Time{})
+		if err != nil {
+			*err = contextError(ctx, *err)
+		}
+	}
+}
+
+// contextError reports that ctx was cancelled or timed out rather than the
+// i/o error that caused
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil && !errors.Is(err, ctx.Err()) {
+		return errors.Wrap(ctx.Err(), err.Error())
+	}
+	return err
+}
+
+// CreateBucket creates a bucket named name, or one the server names when name
+// is empty, that expires after ttl unless ttl is 0. The name of the new
+// bucket is returned.
+func (c *Client) CreateBucket(ctx context.Context, name string, numBytes int64, ttl time.Duration) (_ string, err error) {
+	defer c.watchContext(ctx)(&err)
+
+	if name != "" {
+		bucketName, err := util.ParseBucketName(name)
+		if err != nil {
+			return "", err
+		}
+		name = bucketName.String()
+	}
+	bucketGenerateRequest := util.BucketGenerateRequest{
+		Header:           c.header(util.BucketGenerateMessageType),
+		NumBytesInBucket: numBytes,
+		Name:             name,
+		TimeToLive:       int64(ttl),
+	}
+	err = util.WriteMessageToWriter(c.bufferedWriter, bucketGenerateRequest)
 	if err != nil {
 		return "", errors.Wrap(err, "error writing message to server.")
 	}
 
-	messageBytes, err := readMessageFromServer(c.bufferedReader)
+	bucketGenerateResponseMessage, err := readMessageFromServer(c.bufferedReader)
 	if err != nil {
 		return "", errors.Wrap(err, "error reading message from server.")
 	}
-	bucketGenerateResponseMessage, err := util.DeserializeMessage2(bytes.NewBuffer(messageBytes))
 	switch v := bucketGenerateResponseMessage.(type) {
 	case util.BucketGenerateResponse:
-		return string(v.UniqueIdentifier[:]), nil
+		if v.ErrorCode != util.ErrorCodeNone {
+			return "", newServerError(v.ErrorCode, "")
+		}
+		return v.UniqueIdentifier, nil
+	}
+
+	return "", errors.New("unexpected response to bucket generate")
+}
+
+// contentTypeForFile guesses the type of a file from its extension
+func contentTypeForFile(filePath string) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(filePath)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// startPut asks the server to accept an upload, NumBytes of
+// util.ChunkedUploadLength if its length is unknown
+func (c *Client) startPut(bucketIdentifier string, numBytes int64, contentType string, checksum string) error {
+	bucketName, err := util.ParseBucketName(bucketIdentifier)
+	if err != nil {
+		return err
+	}
+	bucketPutRequest := util.BucketPutBytesRequest{
+		Header:           c.header(util.BucketPutBytesMessageType),
+		UniqueIdentifier: bucketName.String(),
+		NumBytes:         numBytes,
+		ContentType:      contentType,
+		Checksum:         checksum,
+	}
+
+	err = util.WriteMessageToWriter(c.bufferedWriter, bucketPutRequest)
+	if err != nil {
+		return errors.Wrap(err, "error writing message to server.")
+	}
+
+	msg, err := readMessageFromServer(c.bufferedReader)
+	if err != nil {
+		return errors.Wrap(err, "error reading message from server.")
+	}
+	switch v := msg.(type) {
+	case util.BucketPutBytesResponse:
+		if v.ErrorCode != util.ErrorCodeNone {
+			return errors.Wrapf(newServerError(v.ErrorCode, ""), "cannot write data to bucket %s", bucketIdentifier)
+		}
+		return nil
 	}
+	return errors.New("unexpected response to bucket put bytes")
+}
 
-	return "", nil
+// awaitPutCommit waits for the server to store an upload, if it says so
+func (c *Client) awaitPutCommit(bucketIdentifier string) error {
+	if c.features&util.FeatureCommitAck == 0 {
+		return nil
+	}
+	msg, err := readMessageFromServer(c.bufferedReader)
+	if err != nil {
+		return errors.Wrapf(err, "upload to bucket %s was not committed", bucketIdentifier)
+	}
+	if _, ok := msg.(util.BucketPutBytesResponse); !ok {
+		return errors.New("unexpected response to bucket put bytes commit")
+	}
+	return nil
 }
 
-func (c *Client) PutFileInBucket(bucketIdentifier string, filePath string) (uint32, error) {
-	var bucketIdentifierBytes [util.BucketNameLength]byte
-	copy(bucketIdentifierBytes[:], []byte(bucketIdentifier))
+// serverErrorAfterFailedWrite picks up the ErrorResponse a server sends
+// before closing a connection it stopped reading an upload from
+func (c *Client) serverErrorAfterFailedWrite(writeErr error) error {
+	c.theConn.SetReadDeadline(time.Now().Add(time.Second))
+	defer c.theConn.SetReadDeadline(time.Time{})
+	_, err := readMessageFromServer(c.bufferedReader)
+	var serverError *ServerError
+	if errors.As(err, &serverError) {
+		return errors.Wrap(err, "upload stopped by server")
+	}
+	return writeErr
+}
 
+// PutFileInBucket uploads the contents of filePath, reading it twice so the
+// checksum can be sent ahead of the data
+func (c *Client) PutFileInBucket(ctx context.Context, bucketIdentifier string, filePath string) error {
 	f, err := os.Open(filePath)
 	if err != nil {
-		return 0, errors.Wrapf(err, "failure opening file %s", filePath)
+		return errors.Wrapf(err, "failure opening file %s", filePath)
 	}
 	defer f.Close()
 
 	fi, err := f.Stat()
 	if err != nil {
-		return 0, errors.Wrap(err, "error getting stats on file")
+		return errors.Wrap(err, "error getting stats on file")
 	}
+	return c.upload(ctx, bucketIdentifier, f, fi.Size(), contentTypeForFile(filePath))
+}
 
-	bucketPutRequest := util.BucketPutBytesRequest{
-		Header:           util.Header{MessageType: util.BucketPutBytesMessageType, Version: 1},
-		UniqueIdentifier: bucketIdentifierBytes,
-		NumBytes:         fi.Size(),
+// PutReaderInBucket uploads everything read from r without knowing its length
+// up front. The server stops the upload once it outgrows the bucket.
+func (c *Client) PutReaderInBucket(ctx context.Context, bucketIdentifier string, r io.Reader, contentType string) error {
+	return c.upload(ctx, bucketIdentifier, r, -1, contentType)
+}
+
+// Upload replaces the contents of a bucket with size bytes read from r. A
+// negative size uploads until r is exhausted, as long as that fits in the
+// bucket. The checksum is sent ahead of a sized upload when r can be
+// rewound to compute it, otherwise r is sent in chunks followed by the
+// checksum of what was read.
+func (c *Client) Upload(ctx context.Context, bucketIdentifier string, r io.Reader, size int64) error {
+	return c.upload(ctx, bucketIdentifier, r, size, "application/octet-stream")
+}
+
+func (c *Client) upload(ctx context.Context, bucketIdentifier string, r io.Reader, size int64, contentType string) (err error) {
+	defer c.watchContext(ctx)(&err)
+
+	body := &uploadReader{ctx: ctx, r: r}
+	if size < 0 {
+		err = c.uploadChunked(bucketIdentifier, body, size, contentType)
+	} else {
+		err = c.uploadSized(bucketIdentifier, body, size, contentType)
+	}
+	if body.err != nil {
+		// the server is still waiting for the rest of the upload
+		c.theConn.Close()
+		err = errors.Wrapf(body.err, "failure reading upload to bucket %s", bucketIdentifier)
 	}
+	return err
+}
 
-	err = util.WriteMessageToWriter(c.bufferedWriter, bucketPutRequest)
+// uploadReader stops an upload between reads once its context is done and
+// keeps the error so a failing source can be told apart from a failing
+// connection
+type uploadReader struct {
+	ctx context.Context
+	r   io.Reader
+	err error
+}
+
+func (u *uploadReader) Read(p []byte) (int, error) {
+	if err := u.ctx.Err(); err != nil {
+		u.err = err
+		return 0, err
+	}
+	n, err := u.r.Read(p)
+	if err != nil && err != io.EOF {
+		u.err = err
+	}
+	return n, err
+}
+
+func (c *Client) uploadSized(bucketIdentifier string, body *uploadReader, size int64, contentType string) error {
+	rs, ok := body.r.(io.ReadSeeker)
+	if !ok {
+		return c.uploadChunked(bucketIdentifier, body, size, contentType)
+	}
+	checksum, err := checksumReadSeeker(rs, size)
+	if errors.Cause(err) == errNotSeekable {
+		// pipes such as stdin are files that cannot be read twice
+		return c.uploadChunked(bucketIdentifier, body, size, contentType)
+	}
 	if err != nil {
-		return 0, errors.Wrap(err, "error writing message to server.")
+		return err
+	}
+
+	if err := c.startPut(bucketIdentifier, size, contentType, checksum); err != nil {
+		return err
 	}
 
-	messageBytes, err := readMessageFromServer(c.bufferedReader)
+	w := &progressWriter{Writer: c.bufferedWriter, progress: c.progress, bucketIdentifier: bucketIdentifier, total: size}
+	bytesWritten, err := io.CopyN(w, body, size)
+	if body.err != nil {
+		return body.err
+	}
+	if err == io.EOF {
+		// the server is still waiting for the rest so the connection is no use
+		c.theConn.Close()
+		return errors.Errorf("upload to bucket %s ended after %d of %d bytes", bucketIdentifier, bytesWritten, size)
+	}
+	if err == nil {
+		err = c.bufferedWriter.Flush()
+	}
 	if err != nil {
-		return 0, errors.Wrap(err, "error reading message from server.")
+		return c.serverErrorAfterFailedWrite(errors.Wrapf(err, "failed. wrote %d bytes to server.", bytesWritten))
 	}
+	c.logger.Printf("Number of bytes written: %d", bytesWritten)
 
-	msg, err := util.DeserializeMessage2(bytes.NewBuffer(messageBytes))
-	switch v := msg.(type) {
-	case util.BucketPutBytesResponse:
-		if v.ErrorCode != 0 {
-			log.Printf("error cannot write data to bucket error code: %d", v.ErrorCode)
-			os.Exit(1)
+	return c.awaitPutCommit(bucketIdentifier)
+}
+
+// uploadChunked sends the upload in chunks followed by its checksum. A size
+// that is not negative is the exact number of bytes to send.
+func (c *Client) uploadChunked(bucketIdentifier string, body *uploadReader, size int64, contentType string) error {
+	hash, err := util.NewChecksumHash(util.DefaultChecksumAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	if err := c.startPut(bucketIdentifier, util.ChunkedUploadLength, contentType, ""); err != nil {
+		return err
+	}
+
+	var r io.Reader = body
+	if size >= 0 {
+		r = io.LimitReader(body, size)
+	}
+	var bytesWritten int64
+	buff := make([]byte, util.MaxUploadChunkSize)
+	for {
+		bytesRead, readErr := io.ReadFull(r, buff)
+		if bytesRead > 0 {
+			hash.Write(buff[:bytesRead])
+			if err := util.WriteChunk(c.bufferedWriter, buff[:bytesRead]); err != nil {
+				return c.serverErrorAfterFailedWrite(errors.Wrap(err, "error writing bytes to server"))
+			}
+			bytesWritten += int64(bytesRead)
+			c.progress(bucketIdentifier, bytesWritten, size)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
 		}
 	}
+	if size >= 0 && bytesWritten != size {
+		// ending the chunks would store the short upload
+		c.theConn.Close()
+		return errors.Errorf("upload to bucket %s ended after %d of %d bytes", bucketIdentifier, bytesWritten, size)
+	}
 
-	err = writeBytesToServer(c.bufferedWriter, bufio.NewReader(f))
+	if err := util.WriteChunk(c.bufferedWriter, nil); err != nil {
+		return c.serverErrorAfterFailedWrite(errors.Wrap(err, "error writing bytes to server"))
+	}
+	bucketPutBytesTrailer := util.BucketPutBytesTrailer{
+		Header:   c.header(util.BucketPutBytesTrailerMessageType),
+		Checksum: util.FormatChecksum(util.DefaultChecksumAlgorithm, hash),
+	}
+	if err := util.WriteMessageToWriter(c.bufferedWriter, bucketPutBytesTrailer); err != nil {
+		return c.serverErrorAfterFailedWrite(errors.Wrap(err, "error writing message to server."))
+	}
+	c.logger.Printf("Number of bytes written: %d", bytesWritten)
+
+	return c.awaitPutCommit(bucketIdentifier)
+}
+
+// getBucketBytes requests a range of a bucket. The bytes of the range are
+// left to be read from the connection.
+func (c *Client) getBucketBytes(bucketIdentifier string, offset int64, length int64) (util.BucketGetBytesResponse, error) {
+	bucketName, err := util.ParseBucketName(bucketIdentifier)
+	if err != nil {
+		return util.BucketGetBytesResponse{}, err
+	}
+	bucketGetRequest := util.BucketGetBytesRequest{
+		Header:           c.header(util.BucketGetBytesMessageType),
+		UniqueIdentifier: bucketName.String(),
+		Offset:           offset,
+		Length:           length,
+	}
+	err = util.WriteMessageToWriter(c.bufferedWriter, bucketGetRequest)
 	if err != nil {
-		return 0, errors.Wrapf(err, "error writing bytes to server")
+		return util.BucketGetBytesResponse{}, errors.Wrap(err, "error writing message to server.")
 	}
 
-	return 0, nil
+	msg, err := readMessageFromServer(c.bufferedReader)
+	if err != nil {
+		return util.BucketGetBytesResponse{}, errors.Wrap(err, "error reading message from server.")
+	}
+	v, ok := msg.(util.BucketGetBytesResponse)
+	if !ok {
+		return util.BucketGetBytesResponse{}, errors.New("unexpected response to bucket get bytes")
+	}
+	if v.ErrorCode != util.ErrorCodeNone {
+		return v, errors.Wrapf(newServerError(v.ErrorCode, ""), "cannot read data from bucket %s", bucketIdentifier)
+	}
+	return v, nil
 }
 
-func (c *Client) PutBucketInFile(bucketIdentifer string, filePath string) error {
-	var bucketIdentifierBytes [util.BucketNameLength]byte
-	copy(bucketIdentifierBytes[:], []byte(bucketIdentifer))
-	bucketGetRequest := util.BucketGetBytesRequest{Header: util.Header{MessageType: util.BucketGetBytesMessageType, Version: 1}, UniqueIdentifier: bucketIdentifierBytes}
-	err := util.WriteMessageToWriter(c.bufferedWriter, bucketGetRequest)
+func (c *Client) DeleteBucket(ctx context.Context, bucketIdentifier string) (err error) {
+	defer c.watchContext(ctx)(&err)
+
+	bucketName, err := util.ParseBucketName(bucketIdentifier)
+	if err != nil {
+		return err
+	}
+	bucketDeleteRequest := util.BucketDeleteRequest{Header: c.header(util.BucketDeleteMessageType), UniqueIdentifier: bucketName.String()}
+	err = util.WriteMessageToWriter(c.bufferedWriter, bucketDeleteRequest)
 	if err != nil {
 		return errors.Wrap(err, "error writing message to server.")
 	}
 
-	messageBytes, err := readMessageFromServer(c.bufferedReader)
-	msg, err := util.DeserializeMessage2(bytes.NewBuffer(messageBytes))
+	msg, err := readMessageFromServer(c.bufferedReader)
+	if err != nil {
+		return errors.Wrap(err, "error reading message from server.")
+	}
 	switch v := msg.(type) {
-	case util.BucketGetBytesResponse:
-		log.Printf("Error Code: %d", v.ErrorCode)
-		if v.ErrorCode > 0 {
-			return errors.New("error code not 0")
+	case util.BucketDeleteResponse:
+		if v.ErrorCode != util.ErrorCodeNone {
+			return errors.Wrapf(newServerError(v.ErrorCode, ""), "error deleting bucket %s", bucketIdentifier)
 		}
+		return nil
+	}
+
+	return errors.New("unexpected response to bucket delete")
+}
+
+// ExtendBucket makes the bucket expire ttl from now, or never if ttl is 0,
+// and returns when it expires. A bucket that has expired can be extended
+// until the server deletes it.
+func (c *Client) ExtendBucket(ctx context.Context, bucketIdentifier string, ttl time.Duration) (_ time.Time, err error) {
+	defer c.watchContext(ctx)(&err)
+
+	bucketName, err := util.ParseBucketName(bucketIdentifier)
+	if err != nil {
+		return time.Time{}, err
+	}
+	bucketExtendRequest := util.BucketExtendRequest{Header: c.header(util.BucketExtendMessageType), UniqueIdentifier: bucketName.String(), TimeToLive: int64(ttl)}
+	err = util.WriteMessageToWriter(c.bufferedWriter, bucketExtendRequest)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "error writing message to server.")
+	}
+
+	msg, err := readMessageFromServer(c.bufferedReader)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "error reading message from server.")
+	}
+	switch v := msg.(type) {
+	case util.BucketExtendResponse:
+		if v.ErrorCode != util.ErrorCodeNone {
+			return time.Time{}, errors.Wrapf(newServerError(v.ErrorCode, ""), "error extending bucket %s", bucketIdentifier)
+		}
+		if v.ExpiresAt == 0 {
+			return time.Time{}, nil
+		}
+		return time.Unix(0, v.ExpiresAt), nil
+	}
 
-		f, err := os.Create(filePath)
+	return time.Time{}, errors.New("unexpected response to bucket extend")
+}
+
+// ListBuckets returns every bucket the client can access, fetching them from
+// the server a page at a time
+func (c *Client) ListBuckets(ctx context.Context) (_ []BucketInfo, err error) {
+	defer c.watchContext(ctx)(&err)
+
+	buckets := []BucketInfo{}
+	pageToken := ""
+	for {
+		bucketListRequest := util.BucketListRequest{
+			Header:     c.header(util.BucketListMessageType),
+			PageToken:  pageToken,
+			MaxResults: util.DefaultBucketListPageSize,
+		}
+		err := util.WriteMessageToWriter(c.bufferedWriter, bucketListRequest)
 		if err != nil {
-			return errors.Wrapf(err, "failure opening file %s", filePath)
+			return nil, errors.Wrap(err, "error writing message to server.")
 		}
-		defer f.Close()
 
-		buff := make([]byte, 128*1024)
-		var totalBytesRead int64
-		for totalBytesRead < v.Size {
-			var err error
-			bytesRead, err := c.bufferedReader.Read(buff)
-			if bytesRead == 0 && err == io.EOF {
-				break
-			}
-			n, err := f.Write(buff[:bytesRead])
-			if err != nil {
-				return errors.Wrapf(err, "failed to write file. wrote %d bytes", n)
-			}
-			totalBytesRead += int64(bytesRead)
+		msg, err := readMessageFromServer(c.bufferedReader)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading message from server.")
+		}
+		v, ok := msg.(util.BucketListResponse)
+		if !ok {
+			return nil, errors.New("unexpected response to bucket list")
+		}
+		if v.ErrorCode != util.ErrorCodeNone {
+			return nil, errors.Wrap(newServerError(v.ErrorCode, ""), "error listing buckets")
+		}
+		for _, info := range v.Buckets {
+			buckets = append(buckets, newBucketInfo(info))
 		}
+		if v.NextPageToken == "" {
+			return buckets, nil
+		}
+		pageToken = v.NextPageToken
 	}
+}
 
-	return nil
+func (c *Client) StatBucket(ctx context.Context, bucketIdentifier string) (_ BucketInfo, err error) {
+	defer c.watchContext(ctx)(&err)
+	return c.statBucket(bucketIdentifier)
+}
+
+func (c *Client) statBucket(bucketIdentifier string) (BucketInfo, error) {
+	bucketName, err := util.ParseBucketName(bucketIdentifier)
+	if err != nil {
+		return BucketInfo{}, err
+	}
+	bucketStatRequest := util.BucketStatRequest{Header: c.header(util.BucketStatMessageType), UniqueIdentifier: bucketName.String()}
+	err = util.WriteMessageToWriter(c.bufferedWriter, bucketStatRequest)
+	if err != nil {
+		return BucketInfo{}, errors.Wrap(err, "error writing message to server.")
+	}
+
+	msg, err := readMessageFromServer(c.bufferedReader)
+	if err != nil {
+		return BucketInfo{}, errors.Wrap(err, "error reading message from server.")
+	}
+	switch v := msg.(type) {
+	case util.BucketStatResponse:
+		if v.ErrorCode != util.ErrorCodeNone {
+			return BucketInfo{}, errors.Wrapf(newServerError(v.ErrorCode, ""), "error reading bucket %s", bucketIdentifier)
+		}
+		info := newBucketInfo(v.Bucket)
+		info.Owner = v.Owner
+		info.ContentType = v.ContentType
+		info.Checksum = v.Checksum
+		return info, nil
+	}
+
+	return BucketInfo{}, errors.New("unexpected response to bucket stat")
 }
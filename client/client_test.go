@@ -0,0 +1,118 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/genesis32/loft/util"
+	"github.com/pkg/errors"
+)
+
+// startStalledPeer accepts connections and reads everything sent to them
+// without ever answering, except for saying hello back when helloAck is set
+func startStalledPeer(t *testing.T, helloAck bool) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go stall(conn, helloAck)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func stall(conn net.Conn, helloAck bool) {
+	defer conn.Close()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	if helloAck {
+		if _, err := util.ReadMessageFromReader(r); err != nil {
+			return
+		}
+		err := util.WriteMessageToWriter(w, util.HelloAck{
+			Header:          util.Header{MessageType: util.HelloAckMessageType, Version: util.ProtocolVersion1},
+			SelectedVersion: util.MaxProtocolVersion,
+		})
+		if err != nil {
+			return
+		}
+	}
+	io.Copy(ioutil.Discard, r)
+}
+
+// cancelAfter a context cancelled after d
+func cancelAfter(t *testing.T, d time.Duration) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(d, cancel)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestConnectGivesUpOnStalledServer(t *testing.T) {
+	addr := startStalledPeer(t, false)
+	tests := []struct {
+		name     string
+		ctx      func(t *testing.T) context.Context
+		expected error
+	}{
+		{"cancelled", func(t *testing.T) context.Context {
+			return cancelAfter(t, 100*time.Millisecond)
+		}, context.Canceled},
+		{"deadline", func(t *testing.T) context.Context {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			t.Cleanup(cancel)
+			return ctx
+		}, context.DeadlineExceeded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := NewClient(ClientConfiguration{ServerAddrAndPort: addr})
+			errs := make(chan error, 1)
+			go func() { errs <- c.Connect(test.ctx(t)) }()
+			select {
+			case err := <-errs:
+				if !errors.Is(err, test.expected) {
+					t.Fatalf("expected %v got %v", test.expected, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Connect did not give up on a server that never says hello")
+			}
+		})
+	}
+}
+
+func TestCallCancelledOnStalledServer(t *testing.T) {
+	addr := startStalledPeer(t, true)
+	c := NewClient(ClientConfiguration{ServerAddrAndPort: addr})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.CreateBucket(cancelAfter(t, 100*time.Millisecond), "", 10, 0)
+		errs <- err
+	}()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected %v got %v", context.Canceled, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CreateBucket did not give up on a server that never answers")
+	}
+}
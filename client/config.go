@@ -0,0 +1,105 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+const DefaultProfileName = "default"
+
+// ClientConfigFile the client configuration saved by `loft set`. It holds one
+// ClientConfiguration per named profile.
+type ClientConfigFile struct {
+	CurrentProfile string                         `yaml:"current_profile"`
+	Profiles       map[string]ClientConfiguration `yaml:"profiles"`
+}
+
+// DefaultConfigFilePath the config file under the user's config directory
+func DefaultConfigFilePath() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to find user config dir")
+	}
+	return filepath.Join(configDir, "loft", "config.yaml"), nil
+}
+
+// LoadConfigFile reads the client config file. A missing file is treated as
+// an empty one.
+func LoadConfigFile(configFilePath string) (*ClientConfigFile, error) {
+	configFile := &ClientConfigFile{Profiles: map[string]ClientConfiguration{}}
+	configBytes, err := ioutil.ReadFile(configFilePath)
+	if os.IsNotExist(err) {
+		return configFile, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read config file %s", configFilePath)
+	}
+	if err := yaml.UnmarshalStrict(configBytes, configFile); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse config file %s", configFilePath)
+	}
+	if configFile.Profiles == nil {
+		configFile.Profiles = map[string]ClientConfiguration{}
+	}
+	return configFile, nil
+}
+
+// Marshal serializes the config file as yaml
+func (f *ClientConfigFile) Marshal() ([]byte, error) {
+	configBytes, err := yaml.Marshal(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to serialize config")
+	}
+	return configBytes, nil
+}
+
+// Save writes the config file, creating its directory if needed
+func (f *ClientConfigFile) Save(configFilePath string) error {
+	configBytes, err := f.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(configFilePath), 0700); err != nil {
+		return errors.Wrapf(err, "failed to create config dir for %s", configFilePath)
+	}
+	if err := ioutil.WriteFile(configFilePath, configBytes, 0600); err != nil {
+		return errors.Wrapf(err, "failed to write config file %s", configFilePath)
+	}
+	return nil
+}
+
+// ProfileName resolves the profile to use when profileName is empty
+func (f *ClientConfigFile) ProfileName(profileName string) string {
+	if profileName != "" {
+		return profileName
+	}
+	if f.CurrentProfile != "" {
+		return f.CurrentProfile
+	}
+	return DefaultProfileName
+}
+
+// Profile returns the named profile, or the current one if profileName is empty
+func (f *ClientConfigFile) Profile(profileName string) (ClientConfiguration, bool) {
+	profile, ok := f.Profiles[f.ProfileName(profileName)]
+	return profile, ok
+}
+
+// Merge copies every field that is set in other into c
+func (c *ClientConfiguration) Merge(other ClientConfiguration) {
+	if other.ServerAddrAndPort != "" {
+		c.ServerAddrAndPort = other.ServerAddrAndPort
+	}
+	if other.SslClientCertFilePath != "" {
+		c.SslClientCertFilePath = other.SslClientCertFilePath
+	}
+	if other.SslIdentityCertFilePath != "" {
+		c.SslIdentityCertFilePath = other.SslIdentityCertFilePath
+	}
+	if other.SslIdentityKeyFilePath != "" {
+		c.SslIdentityKeyFilePath = other.SslIdentityKeyFilePath
+	}
+}
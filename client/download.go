@@ -0,0 +1,267 @@
+package client
+
+import (
+	"context"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/genesis32/loft/util"
+	"github.com/pkg/errors"
+)
+
+// downloadVerifier checks a download against the checksum the server stored
+// for the bucket. Buckets that were never uploaded to have no checksum to
+// verify.
+type downloadVerifier struct {
+	hash.Hash
+	algorithm string
+	expected  string
+}
+
+func newDownloadVerifier(bucketIdentifier string, checksum string, verify bool) (*downloadVerifier, error) {
+	verifier := &downloadVerifier{algorithm: util.DefaultChecksumAlgorithm}
+	if verify && checksum != "" {
+		algorithm, err := util.ChecksumAlgorithm(checksum)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot verify bucket %s", bucketIdentifier)
+		}
+		verifier.algorithm = algorithm
+		verifier.expected = checksum
+	}
+	var err error
+	verifier.Hash, err = util.NewChecksumHash(verifier.algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return verifier, nil
+}
+
+func (d *downloadVerifier) verify(bucketIdentifier string) error {
+	if d.expected == "" {
+		return nil
+	}
+	checksum := util.FormatChecksum(d.algorithm, d.Hash)
+	if checksum != d.expected {
+		return errors.Wrapf(ErrChecksumMismatch, "bucket %s downloaded with checksum %s expected %s", bucketIdentifier, checksum, d.expected)
+	}
+	return nil
+}
+
+// downloadReader reads the bytes of a bucket off the connection. With a
+// verifier the checksum is checked once the last byte is read and a mismatch
+// is returned in place of io.EOF.
+type downloadReader struct {
+	ctx              context.Context
+	client           *Client
+	bucketIdentifier string
+	size             int64
+	remaining        int64
+	verifier         *downloadVerifier
+	stop             func(*error)
+	err              error
+}
+
+func (c *Client) newDownloadReader(ctx context.Context, bucketIdentifier string, size int64, stop func(*error)) *downloadReader {
+	return &downloadReader{
+		ctx:              ctx,
+		client:           c,
+		bucketIdentifier: bucketIdentifier,
+		size:             size,
+		remaining:        size,
+		stop:             stop,
+	}
+}
+
+func (d *downloadReader) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if d.remaining == 0 {
+		d.finish()
+		return 0, d.err
+	}
+	if int64(len(p)) > d.remaining {
+		p = p[:d.remaining]
+	}
+	n, err := d.client.bufferedReader.Read(p)
+	d.remaining -= int64(n)
+	if d.verifier != nil {
+		d.verifier.Write(p[:n])
+	}
+	d.client.progress(d.bucketIdentifier, d.size-d.remaining, d.size)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		d.err = contextError(d.ctx, errors.Wrapf(err, "failed to download bucket %s. read %d of %d bytes", d.bucketIdentifier, d.size-d.remaining, d.size))
+		return n, d.err
+	}
+	if d.remaining == 0 {
+		d.finish()
+		if d.err != io.EOF {
+			return n, d.err
+		}
+	}
+	return n, nil
+}
+
+func (d *downloadReader) finish() {
+	d.err = io.EOF
+	if d.verifier != nil {
+		if err := d.verifier.verify(d.bucketIdentifier); err != nil {
+			d.err = err
+			return
+		}
+		if d.verifier.expected != "" {
+			d.client.logger.Printf("verified %s", d.verifier.expected)
+		}
+	}
+}
+
+// Close closes the connection to the server as well if the download was not
+// read to the end, so Connect has to be called again before the next call.
+func (d *downloadReader) Close() error {
+	if d.stop != nil {
+		d.stop(nil)
+		d.stop = nil
+	}
+	if d.remaining > 0 {
+		d.remaining = 0
+		if d.err == nil {
+			d.err = errors.New("download closed")
+		}
+		return d.client.theConn.Close()
+	}
+	return nil
+}
+
+// Download streams the contents of a bucket, which are checked against the
+// checksum the server stored for them once the last byte is read. The reader
+// has to be closed before the client is used again.
+func (c *Client) Download(ctx context.Context, bucketIdentifier string) (io.ReadCloser, BucketInfo, error) {
+	stop := c.watchContext(ctx)
+	info, err := c.statBucket(bucketIdentifier)
+	if err != nil {
+		stop(&err)
+		return nil, BucketInfo{}, err
+	}
+	v, err := c.getBucketBytes(bucketIdentifier, 0, -1)
+	if err != nil {
+		stop(&err)
+		return nil, BucketInfo{}, err
+	}
+	body := c.newDownloadReader(ctx, bucketIdentifier, v.Size, stop)
+	if body.verifier, err = newDownloadVerifier(bucketIdentifier, v.Checksum, true); err != nil {
+		body.Close()
+		return nil, BucketInfo{}, err
+	}
+
+	info.Size = v.ContentLength
+	info.Checksum = v.Checksum
+	return body, info, nil
+}
+
+// PutBucketInFile downloads a bucket into filePath. With resume set an
+// existing file is taken to be the start of the bucket and only the rest is
+// downloaded. With verify set the file is checked against the checksum the
+// server stored for the bucket and removed if it does not match.
+func (c *Client) PutBucketInFile(ctx context.Context, bucketIdentifer string, filePath string, verify bool, resume bool) (err error) {
+	defer c.watchContext(ctx)(&err)
+
+	var offset int64
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if resume {
+		fi, err := os.Stat(filePath)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "failure opening file %s", filePath)
+		}
+		if err == nil {
+			offset = fi.Size()
+		}
+		flags = os.O_RDWR | os.O_CREATE | os.O_APPEND
+	}
+
+	v, err := c.getBucketBytes(bucketIdentifer, offset, -1)
+	if errors.Is(err, ErrInvalidRange) {
+		return errors.Wrapf(err, "file %s is larger than bucket %s, remove it to download again", filePath, bucketIdentifer)
+	}
+	if err != nil {
+		return err
+	}
+	body := c.newDownloadReader(ctx, bucketIdentifer, v.Size, nil)
+	defer body.Close()
+	if body.verifier, err = newDownloadVerifier(bucketIdentifer, v.Checksum, verify); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filePath, flags, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failure opening file %s", filePath)
+	}
+	defer f.Close()
+
+	if offset > 0 {
+		c.logger.Printf("resuming download at %d of %d bytes", offset, v.ContentLength)
+		if verify {
+			if _, err := io.CopyN(body.verifier, f, offset); err != nil {
+				return errors.Wrapf(err, "failure reading file %s", filePath)
+			}
+		}
+	}
+
+	_, err = io.Copy(f, body)
+	if errors.Is(err, ErrChecksumMismatch) {
+		f.Close()
+		os.Remove(filePath)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "failure closing file %s", filePath)
+	}
+	return nil
+}
+
+// PutBucketInWriter streams a bucket to w. With verify set a mismatch against
+// the checksum the server stored can only be reported after every byte has
+// been written.
+func (c *Client) PutBucketInWriter(ctx context.Context, bucketIdentifer string, w io.Writer, verify bool) (err error) {
+	defer c.watchContext(ctx)(&err)
+
+	v, err := c.getBucketBytes(bucketIdentifer, 0, -1)
+	if err != nil {
+		return err
+	}
+	body := c.newDownloadReader(ctx, bucketIdentifer, v.Size, nil)
+	defer body.Close()
+	if body.verifier, err = newDownloadVerifier(bucketIdentifer, v.Checksum, verify); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, body)
+	return err
+}
+
+// PutBucketRangeInWriter writes length bytes of a bucket starting at offset to
+// w. A negative offset counts back from the end of the bucket and a negative
+// length reads to the end. A range cannot be checked against the checksum of
+// the whole bucket so it is not verified.
+func (c *Client) PutBucketRangeInWriter(ctx context.Context, bucketIdentifer string, w io.Writer, offset int64, length int64) (err error) {
+	defer c.watchContext(ctx)(&err)
+
+	v, err := c.getBucketBytes(bucketIdentifer, offset, length)
+	if err != nil {
+		return err
+	}
+	body := c.newDownloadReader(ctx, bucketIdentifer, v.Size, nil)
+	defer body.Close()
+
+	if _, err := io.Copy(w, body); err != nil {
+		return err
+	}
+	c.logger.Printf("downloaded bytes %d to %d of %d", v.Offset, v.Offset+v.Size, v.ContentLength)
+	return nil
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/genesis32/loft/util"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrBucketNotFound        = errors.New(util.ErrorCodeText(util.ErrorCodeBucketNotFound))
+	ErrBucketTooSmall        = errors.New(util.ErrorCodeText(util.ErrorCodeBucketTooSmall))
+	ErrIOFailure             = errors.New(util.ErrorCodeText(util.ErrorCodeIOFailure))
+	ErrForbidden             = errors.New(util.ErrorCodeText(util.ErrorCodeForbidden))
+	ErrUnsupportedVersion    = errors.New(util.ErrorCodeText(util.ErrorCodeUnsupportedVersion))
+	ErrMalformedMessage      = errors.New(util.ErrorCodeText(util.ErrorCodeMalformedMessage))
+	ErrInternal              = errors.New(util.ErrorCodeText(util.ErrorCodeInternal))
+	ErrBucketTooLarge        = errors.New(util.ErrorCodeText(util.ErrorCodeBucketTooLarge))
+	ErrChecksumMismatch      = errors.New(util.ErrorCodeText(util.ErrorCodeChecksumMismatch))
+	ErrUploadSessionNotFound = errors.New(util.ErrorCodeText(util.ErrorCodeUploadSessionNotFound))
+	ErrInvalidRange          = errors.New(util.ErrorCodeText(util.ErrorCodeInvalidRange))
+	ErrInvalidBucketName     = util.ErrInvalidBucketName
+	ErrBucketExists          = errors.New(util.ErrorCodeText(util.ErrorCodeBucketExists))
+	ErrBucketExpired         = errors.New(util.ErrorCodeText(util.ErrorCodeBucketExpired))
+	ErrQuotaExceeded         = errors.New(util.ErrorCodeText(util.ErrorCodeQuotaExceeded))
+)
+
+var errorCodeErrors = map[int32]error{
+	util.ErrorCodeBucketNotFound:        ErrBucketNotFound,
+	util.ErrorCodeBucketTooSmall:        ErrBucketTooSmall,
+	util.ErrorCodeIOFailure:             ErrIOFailure,
+	util.ErrorCodeForbidden:             ErrForbidden,
+	util.ErrorCodeUnsupportedVersion:    ErrUnsupportedVersion,
+	util.ErrorCodeMalformedMessage:      ErrMalformedMessage,
+	util.ErrorCodeInternal:              ErrInternal,
+	util.ErrorCodeBucketTooLarge:        ErrBucketTooLarge,
+	util.ErrorCodeChecksumMismatch:      ErrChecksumMismatch,
+	util.ErrorCodeUploadSessionNotFound: ErrUploadSessionNotFound,
+	util.ErrorCodeInvalidRange:          ErrInvalidRange,
+	util.ErrorCodeInvalidBucketName:     ErrInvalidBucketName,
+	util.ErrorCodeBucketExists:          ErrBucketExists,
+	util.ErrorCodeBucketExpired:         ErrBucketExpired,
+	util.ErrorCodeQuotaExceeded:         ErrQuotaExceeded,
+}
+
+// ServerError an error reported by the server. It matches the Err* value for
+// its code with errors.Is.
+type ServerError struct {
+	ErrorCode int32
+	Message   string
+}
+
+func newServerError(errorCode int32, message string) error {
+	return &ServerError{ErrorCode: errorCode, Message: message}
+}
+
+func (e *ServerError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("server error: %s", util.ErrorCodeText(e.ErrorCode))
+	}
+	return fmt.Sprintf("server error: %s: %s", util.ErrorCodeText(e.ErrorCode), e.Message)
+}
+
+func (e *ServerError) Is(target error) bool {
+	return errorCodeErrors[e.ErrorCode] == target
+}
+
+// IsRetryable reports whether err is a transient failure, such as a network
+// error or a server i/o failure, as opposed to a permanent one like a missing
+// bucket.
+func IsRetryable(err error) bool {
+	var serverError *ServerError
+	if errors.As(err, &serverError) {
+		return util.ErrorCodeRetryable(serverError.ErrorCode)
+	}
+	var netError net.Error
+	return errors.As(err, &netError)
+}
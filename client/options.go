@@ -0,0 +1,44 @@
+package client
+
+import (
+	"io"
+	"log"
+)
+
+// Option configures a Client created by NewClient
+type Option func(*Client)
+
+// ProgressFunc is called as the bytes of an upload or download go over the
+// connection. total is -1 for an upload of unknown size.
+type ProgressFunc func(bucketIdentifier string, transferred int64, total int64)
+
+// WithLogger logs what the client is doing to logger. Nothing is logged by
+// default.
+func WithLogger(logger *log.Logger) Option {
+	return func(c *Client) {
+		c.logger = logger
+	}
+}
+
+// WithProgress reports the progress of every upload and download to progress
+func WithProgress(progress ProgressFunc) Option {
+	return func(c *Client) {
+		c.progress = progress
+	}
+}
+
+// progressWriter reports the bytes of an upload as they are written
+type progressWriter struct {
+	io.Writer
+	progress         ProgressFunc
+	bucketIdentifier string
+	written          int64
+	total            int64
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.written += int64(n)
+	w.progress(w.bucketIdentifier, w.written, w.total)
+	return n, err
+}
@@ -0,0 +1,221 @@
+package client
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/genesis32/loft/util"
+	"github.com/pkg/errors"
+)
+
+// errNotSeekable the upload cannot be rewound, e.g. it is a pipe, and nothing
+// has been read from it
+var errNotSeekable = errors.New("upload cannot be rewound")
+
+// checksumReadSeeker returns the checksum of the next size bytes of rs and
+// rewinds it to where it was
+func checksumReadSeeker(rs io.ReadSeeker, size int64) (string, error) {
+	hash, err := util.NewChecksumHash(util.DefaultChecksumAlgorithm)
+	if err != nil {
+		return "", err
+	}
+	start, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", errors.Wrapf(errNotSeekable, "failure seeking upload: %v", err)
+	}
+	if _, err := io.CopyN(hash, rs, size); err != nil {
+		return "", errors.Wrap(err, "failure reading upload")
+	}
+	if _, err := rs.Seek(start, io.SeekStart); err != nil {
+		return "", errors.Wrap(err, "failure rewinding upload")
+	}
+	return util.FormatChecksum(util.DefaultChecksumAlgorithm, hash), nil
+}
+
+// StartUploadSession opens an upload session for the contents of filePath and
+// returns its id. Nothing is sent until ResumeUploadSession is called.
+func (c *Client) StartUploadSession(ctx context.Context, bucketIdentifier string, filePath string) (_ string, err error) {
+	defer c.watchContext(ctx)(&err)
+
+	bucketName, err := util.ParseBucketName(bucketIdentifier)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", errors.Wrapf(err, "failure opening file %s", filePath)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", errors.Wrap(err, "error getting stats on file")
+	}
+	checksum, err := checksumReadSeeker(f, fi.Size())
+	if err != nil {
+		return "", errors.Wrapf(err, "failure checksumming file %s", filePath)
+	}
+
+	uploadSessionOpenRequest := util.UploadSessionOpenRequest{
+		Header:           c.header(util.UploadSessionOpenMessageType),
+		UniqueIdentifier: bucketName.String(),
+		NumBytes:         fi.Size(),
+		ContentType:      contentTypeForFile(filePath),
+		Checksum:         checksum,
+	}
+	err = util.WriteMessageToWriter(c.bufferedWriter, uploadSessionOpenRequest)
+	if err != nil {
+		return "", errors.Wrap(err, "error writing message to server.")
+	}
+
+	msg, err := readMessageFromServer(c.bufferedReader)
+	if err != nil {
+		return "", errors.Wrap(err, "error reading message from server.")
+	}
+	switch v := msg.(type) {
+	case util.UploadSessionOpenResponse:
+		if v.ErrorCode != util.ErrorCodeNone {
+			return "", errors.Wrapf(newServerError(v.ErrorCode, ""), "cannot start upload to bucket %s", bucketIdentifier)
+		}
+		c.logger.Printf("started upload session %s", v.SessionID)
+		return v.SessionID, nil
+	}
+
+	return "", errors.New("unexpected response to upload session open")
+}
+
+// uploadSessionStatus returns how many bytes of the upload the server has and
+// how many it expects
+func (c *Client) uploadSessionStatus(sessionID string) (int64, int64, error) {
+	uploadSessionStatusRequest := util.UploadSessionStatusRequest{Header: c.header(util.UploadSessionStatusMessageType), SessionID: sessionID}
+	err := util.WriteMessageToWriter(c.bufferedWriter, uploadSessionStatusRequest)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "error writing message to server.")
+	}
+
+	msg, err := readMessageFromServer(c.bufferedReader)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "error reading message from server.")
+	}
+	switch v := msg.(type) {
+	case util.UploadSessionStatusResponse:
+		if v.ErrorCode != util.ErrorCodeNone {
+			return 0, 0, errors.Wrapf(newServerError(v.ErrorCode, ""), "cannot read upload session %s", sessionID)
+		}
+		return v.Offset, v.NumBytes, nil
+	}
+
+	return 0, 0, errors.New("unexpected response to upload session status")
+}
+
+func (c *Client) uploadSessionChunk(sessionID string, offset int64, data []byte) (int64, error) {
+	uploadSessionChunkRequest := util.UploadSessionChunkRequest{
+		Header:    c.header(util.UploadSessionChunkMessageType),
+		SessionID: sessionID,
+		Offset:    offset,
+		Data:      data,
+	}
+	err := util.WriteMessageToWriter(c.bufferedWriter, uploadSessionChunkRequest)
+	if err != nil {
+		return 0, errors.Wrap(err, "error writing message to server.")
+	}
+
+	msg, err := readMessageFromServer(c.bufferedReader)
+	if err != nil {
+		return 0, errors.Wrap(err, "error reading message from server.")
+	}
+	switch v := msg.(type) {
+	case util.UploadSessionChunkResponse:
+		if v.ErrorCode != util.ErrorCodeNone {
+			return 0, errors.Wrapf(newServerError(v.ErrorCode, ""), "cannot upload to session %s", sessionID)
+		}
+		return v.Offset, nil
+	}
+
+	return 0, errors.New("unexpected response to upload session chunk")
+}
+
+func (c *Client) uploadSessionCommit(sessionID string) (string, error) {
+	uploadSessionCommitRequest := util.UploadSessionCommitRequest{Header: c.header(util.UploadSessionCommitMessageType), SessionID: sessionID}
+	err := util.WriteMessageToWriter(c.bufferedWriter, uploadSessionCommitRequest)
+	if err != nil {
+		return "", errors.Wrap(err, "error writing message to server.")
+	}
+
+	msg, err := readMessageFromServer(c.bufferedReader)
+	if err != nil {
+		return "", errors.Wrap(err, "error reading message from server.")
+	}
+	switch v := msg.(type) {
+	case util.UploadSessionCommitResponse:
+		if v.ErrorCode != util.ErrorCodeNone {
+			return "", errors.Wrapf(newServerError(v.ErrorCode, ""), "cannot commit upload session %s", sessionID)
+		}
+		return v.Checksum, nil
+	}
+
+	return "", errors.New("unexpected response to upload session commit")
+}
+
+// ResumeUploadSession sends whatever part of filePath the server does not have
+// yet and commits the upload. If the connection drops it can be called again
+// with the same session id on a new connection.
+func (c *Client) ResumeUploadSession(ctx context.Context, sessionID string, filePath string) (err error) {
+	defer c.watchContext(ctx)(&err)
+
+	offset, numBytes, err := c.uploadSessionStatus(sessionID)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return errors.Wrapf(err, "failure opening file %s", filePath)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "error getting stats on file")
+	}
+	if fi.Size() != numBytes {
+		return errors.Errorf("file %s is %d bytes but upload session %s expects %d", filePath, fi.Size(), sessionID, numBytes)
+	}
+	if offset > 0 {
+		c.logger.Printf("resuming upload session %s at %d of %d bytes", sessionID, offset, numBytes)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "failure seeking file %s", filePath)
+	}
+
+	buff := make([]byte, util.MaxUploadChunkSize)
+	for offset < numBytes {
+		bytesRead, err := io.ReadFull(f, buff[:minInt64(int64(len(buff)), numBytes-offset)])
+		if err != nil {
+			return errors.Wrapf(err, "failure reading file %s", filePath)
+		}
+		offset, err = c.uploadSessionChunk(sessionID, offset, buff[:bytesRead])
+		if err != nil {
+			return err
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return errors.Wrapf(err, "failure seeking file %s", filePath)
+		}
+	}
+
+	checksum, err := c.uploadSessionCommit(sessionID)
+	if err != nil {
+		return err
+	}
+	c.logger.Printf("committed %d bytes with checksum %s", numBytes, checksum)
+	return nil
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
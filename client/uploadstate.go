@@ -0,0 +1,84 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// UploadState what `loft bucket upload --resume` remembers about an upload so
+// that running it again continues where it stopped
+type UploadState struct {
+	SessionID string    `yaml:"session_id"`
+	Server    string    `yaml:"server"`
+	Bucket    string    `yaml:"bucket"`
+	FilePath  string    `yaml:"file_path"`
+	Size      int64     `yaml:"size"`
+	ModTime   time.Time `yaml:"mod_time"`
+}
+
+// UploadStateFilePath the state file for uploading filePath to a bucket under
+// the user's cache directory
+func UploadStateFilePath(serverAddrAndPort string, bucketIdentifier string, filePath string) (string, error) {
+	absFilePath, err := filepath.Abs(filePath)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to resolve %s", filePath)
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to find user cache dir")
+	}
+	key := sha256.Sum256([]byte(serverAddrAndPort + "\x00" + bucketIdentifier + "\x00" + absFilePath))
+	return filepath.Join(cacheDir, "loft", "uploads", hex.EncodeToString(key[:8])+".yaml"), nil
+}
+
+// LoadUploadState returns nil if there is no state file
+func LoadUploadState(stateFilePath string) (*UploadState, error) {
+	stateBytes, err := ioutil.ReadFile(stateFilePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read upload state %s", stateFilePath)
+	}
+	state := &UploadState{}
+	if err := yaml.Unmarshal(stateBytes, state); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse upload state %s", stateFilePath)
+	}
+	return state, nil
+}
+
+// Save writes the state file, creating its directory if needed
+func (s *UploadState) Save(stateFilePath string) error {
+	stateBytes, err := yaml.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "failed to serialize upload state")
+	}
+	if err := os.MkdirAll(filepath.Dir(stateFilePath), 0700); err != nil {
+		return errors.Wrapf(err, "failed to create upload state dir for %s", stateFilePath)
+	}
+	if err := ioutil.WriteFile(stateFilePath, stateBytes, 0600); err != nil {
+		return errors.Wrapf(err, "failed to write upload state %s", stateFilePath)
+	}
+	return nil
+}
+
+// Matches reports whether the file being uploaded is unchanged since the
+// state was saved
+func (s *UploadState) Matches(fi os.FileInfo) bool {
+	return s.Size == fi.Size() && s.ModTime.Equal(fi.ModTime())
+}
+
+// RemoveUploadState deletes the state file once the upload is committed
+func RemoveUploadState(stateFilePath string) error {
+	if err := os.Remove(stateFilePath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove upload state %s", stateFilePath)
+	}
+	return nil
+}
@@ -1,20 +1,32 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"os/user"
 	"path"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
 
 	"github.com/genesis32/loft/client"
 	"github.com/genesis32/loft/server"
 	"github.com/genesis32/loft/util"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var serverConfig server.ServerConfiguration
+var serverConfigFilePath string
+var commandTimeout time.Duration
 var clientConfig client.ClientConfiguration
+var clientConfigFilePath string
+var clientProfileName string
 
 func init() {
 
@@ -25,32 +37,92 @@ func init() {
 	defaultBucketPath := path.Join(user.HomeDir, "loft", "buckets")
 
 	ServerCmd.Flags().StringVarP(&serverConfig.BucketPath, "bucket-path", "b", defaultBucketPath, "the bucket path")
+	ServerCmd.Flags().StringVar(&serverConfig.StorageBackend, "storage", server.StorageBackendFilesystem, "where buckets are stored: filesystem or memory")
 	ServerCmd.Flags().StringVarP(&serverConfig.SslClientKeyFilePath, "key", "k", "", "the server private key")
 	ServerCmd.Flags().StringVarP(&serverConfig.SslClientCertFilePath, "cert", "c", "", "the server certificate to present")
+	ServerCmd.Flags().StringVar(&serverConfig.SslClientCAFilePath, "client-ca", "", "the ca that client certificates must be signed by")
 	ServerCmd.Flags().StringVarP(&serverConfig.ListenAddrAndPort, "listen", "l", ":8089", "the port to listen on")
+	ServerCmd.Flags().Int64Var(&serverConfig.MaxBucketSize, "max-bucket-size", 0, "the largest bucket in bytes a client may create, 0 for no limit")
+	ServerCmd.Flags().StringVar(&serverConfig.LogFilePath, "log-file", "", "the file to log to instead of stderr")
+	ServerCmd.Flags().DurationVar(&serverConfig.UploadSessionIdleTimeout, "upload-session-idle-timeout", time.Hour, "how long an unfinished resumable upload is kept without hearing from the client")
+	ServerCmd.Flags().IntVar(&serverConfig.MaxUploadSessionsPerOwner, "max-upload-sessions-per-owner", 16, "how many resumable uploads one owner may have unfinished at once, 0 for no limit")
+	ServerCmd.Flags().DurationVar(&serverConfig.IdleTimeout, "idle-timeout", 5*time.Minute, "how long a connection is kept open waiting for a request")
+	ServerCmd.Flags().DurationVar(&serverConfig.HeaderReadTimeout, "header-read-timeout", 30*time.Second, "how long a client has to finish sending a request once it starts")
+	ServerCmd.Flags().DurationVar(&serverConfig.TransferTimeout, "transfer-timeout", time.Minute, "how long an upload or download may stall before the connection is closed")
+	ServerCmd.Flags().IntVar(&serverConfig.BucketNameLength, "bucket-name-length", util.DefaultBucketNameLength, "how many characters generated bucket names have")
+	ServerCmd.Flags().DurationVar(&serverConfig.ExpirySweepInterval, "expiry-sweep-interval", time.Minute, "how often expired buckets are looked for")
+	ServerCmd.Flags().Int64Var(&serverConfig.Quota, "quota", 0, "the most bytes all buckets together may hold, 0 for no limit")
+	ServerCmd.Flags().Int64Var(&serverConfig.OwnerQuota, "owner-quota", 0, "the most bytes the buckets of one owner may hold, 0 for no limit")
+	ServerCmd.Flags().Int64Var(&serverConfig.MinFreeSpace, "min-free-space", 0, "the bytes of disk to leave free when creating or uploading to a bucket")
+	ServerCmd.Flags().DurationVar(&serverConfig.ExpiryGracePeriod, "expiry-grace-period", 24*time.Hour, "how long an expired bucket is reported as expired before it is deleted")
+	ServerCmd.Flags().StringVar(&serverConfigFilePath, "config", "", "the yaml configuration file, overridden by any flags given")
 
 	BucketCmd.PersistentFlags().StringVarP(&clientConfig.ServerAddrAndPort, "server", "s", "localhost:8089", "the server to connect to")
 	BucketCmd.PersistentFlags().StringVarP(&clientConfig.SslClientCertFilePath, "cert", "c", "", "the server cert to auth with")
+	BucketCmd.PersistentFlags().StringVar(&clientConfig.SslIdentityCertFilePath, "identity-cert", "", "the client certificate to present")
+	BucketCmd.PersistentFlags().StringVar(&clientConfig.SslIdentityKeyFilePath, "identity-key", "", "the client private key")
+	BucketCmd.PersistentFlags().DurationVar(&commandTimeout, "timeout", 0, "give up on the command after this long, 0 for no limit")
 
 	BucketCreateCmd.Flags().Int64P("size", "n", 1024*1024, "number of bytes in the bucket")
+	BucketCreateCmd.Flags().Duration("ttl", 0, "delete the bucket after this long, 0 to keep it")
+
+	BucketExtendCmd.Flags().Duration("ttl", 0, "expire the bucket this long from now, 0 to keep it")
+	BucketExtendCmd.MarkFlagRequired("ttl")
+
+	BucketDeleteCmd.Flags().StringP("bucket-name", "i", "", "bucket name")
+
+	BucketListCmd.Flags().String("output", "table", "output format: table or json")
+
+	BucketInfoCmd.Flags().String("output", "table", "output format: table or json")
 
 	BucketDownloadCmd.Flags().StringP("bucket-name", "i", "", "bucket name")
-	BucketDownloadCmd.Flags().StringP("output-file", "o", "", "output file")
+	BucketDownloadCmd.Flags().StringP("output-file", "o", "", "output file, - for stdout")
+	BucketDownloadCmd.Flags().Bool("verify", true, "check the download against the checksum stored on the server")
+	BucketDownloadCmd.Flags().Bool("resume", false, "only download what is missing from an existing output file")
+	BucketDownloadCmd.Flags().Int64("offset", 0, "download from this byte, counting back from the end if negative")
+	BucketDownloadCmd.Flags().Int64("length", -1, "download at most this many bytes, -1 for the rest of the bucket")
 
-	BucketUploadCmd.Flags().StringP("input-file", "i", "", "filename")
+	BucketUploadCmd.Flags().StringP("input-file", "i", "", "filename, - for stdin")
 	BucketUploadCmd.Flags().StringP("bucket-name", "o", "", "bucket name")
+	BucketUploadCmd.Flags().Bool("resume", false, "upload through a session that continues where an interrupted upload stopped")
+
+	SetCmd.Flags().StringP("cert", "c", "", "the server cert to auth with")
+	SetCmd.Flags().String("identity-cert", "", "the client certificate to present")
+	SetCmd.Flags().String("identity-key", "", "the client private key")
 
 	RootCmd.PersistentFlags().BoolVarP(&util.Verbose, "verbose", "v", false, "verbose output")
+	RootCmd.PersistentFlags().StringVar(&clientProfileName, "profile", "", "the client config profile to use")
+	RootCmd.PersistentFlags().StringVar(&clientConfigFilePath, "client-config", "", "the client config file (default loft/config.yaml in the user config dir)")
 
 	BucketCmd.AddCommand(BucketCreateCmd)
 	BucketCmd.AddCommand(BucketUploadCmd)
 	BucketCmd.AddCommand(BucketDownloadCmd)
 	BucketCmd.AddCommand(BucketDeleteCmd)
+	BucketCmd.AddCommand(BucketListCmd)
+	BucketCmd.AddCommand(BucketInfoCmd)
+	BucketCmd.AddCommand(BucketExtendCmd)
 
 	RootCmd.AddCommand(BucketCmd)
 	RootCmd.AddCommand(ServerCmd)
 	RootCmd.AddCommand(VersionCmd)
 	RootCmd.AddCommand(SetCmd)
+
+	ConfigCmd.AddCommand(ConfigViewCmd)
+	ConfigCmd.AddCommand(ConfigUseCmd)
+	RootCmd.AddCommand(ConfigCmd)
+}
+
+func openClientConfigFile() (string, *client.ClientConfigFile, error) {
+	configFilePath := clientConfigFilePath
+	if configFilePath == "" {
+		var err error
+		configFilePath, err = client.DefaultConfigFilePath()
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	configFile, err := client.LoadConfigFile(configFilePath)
+	return configFilePath, configFile, err
 }
 
 var RootCmd = &cobra.Command{
@@ -67,37 +139,189 @@ var VersionCmd = &cobra.Command{
 	},
 }
 
+// absFilePath filePath made absolute, leaving empty paths empty
+func absFilePath(filePath string) (string, error) {
+	if filePath == "" {
+		return "", nil
+	}
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to find absolute path of %s", filePath)
+	}
+	return absPath, nil
+}
+
 var SetCmd = &cobra.Command{
-	Use: "set",
+	Use:   "set [server addr]",
+	Short: "save the server and certificates to use in the client config profile",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		configFilePath, configFile, err := openClientConfigFile()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		profileName := configFile.ProfileName(clientProfileName)
+		profile := configFile.Profiles[profileName]
+		if len(args) > 0 {
+			profile.ServerAddrAndPort = args[0]
+		}
+		for name, filePath := range map[string]*string{
+			"cert":          &profile.SslClientCertFilePath,
+			"identity-cert": &profile.SslIdentityCertFilePath,
+			"identity-key":  &profile.SslIdentityKeyFilePath,
+		} {
+			if !cmd.Flags().Changed(name) {
+				continue
+			}
+			// the profile is used from other directories so paths are saved
+			// relative to none of them
+			value, _ := cmd.Flags().GetString(name)
+			if *filePath, err = absFilePath(value); err != nil {
+				log.Fatal(err)
+			}
+		}
+		configFile.Profiles[profileName] = profile
+		if configFile.CurrentProfile == "" {
+			configFile.CurrentProfile = profileName
+		}
+
+		if err := configFile.Save(configFilePath); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("saved profile:%s to %s\n", profileName, configFilePath)
+	},
+}
+
+var ConfigCmd = &cobra.Command{
+	Use: "config",
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("set the server comment")
+		fmt.Println("config")
+	},
+}
+
+var ConfigViewCmd = &cobra.Command{
+	Use:   "view",
+	Short: "print the client config file",
+	Run: func(cmd *cobra.Command, args []string) {
+		configFilePath, configFile, err := openClientConfigFile()
+		if err != nil {
+			log.Fatal(err)
+		}
+		configBytes, err := configFile.Marshal()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("# %s\n%s", configFilePath, configBytes)
 	},
 }
 
+var ConfigUseCmd = &cobra.Command{
+	Use:   "use <profile>",
+	Short: "make a profile the one used by default",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		configFilePath, configFile, err := openClientConfigFile()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, ok := configFile.Profiles[args[0]]; !ok {
+			log.Fatalf("no profile named %s in %s", args[0], configFilePath)
+		}
+		configFile.CurrentProfile = args[0]
+		if err := configFile.Save(configFilePath); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("using profile:%s\n", args[0])
+	},
+}
+
+// loadWithFlagPrecedence runs load, which may overwrite variables bound to
+// flags, and then restores every flag given on the command line so that flags
+// take precedence over anything loaded.
+func loadWithFlagPrecedence(flags *pflag.FlagSet, load func() error) error {
+	changedFlags := map[string]string{}
+	flags.Visit(func(flag *pflag.Flag) {
+		changedFlags[flag.Name] = flag.Value.String()
+	})
+	if err := load(); err != nil {
+		return err
+	}
+	for name, value := range changedFlags {
+		if err := flags.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadServerConfiguration reads the server config file, if one was given,
+// under the flags given on the command line
+func loadServerConfiguration(flags *pflag.FlagSet) error {
+	if serverConfigFilePath != "" {
+		err := loadWithFlagPrecedence(flags, func() error {
+			return server.LoadConfiguration(serverConfigFilePath, &serverConfig)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// the verbose flag belongs to every command rather than the server
+	// configuration so its precedence is applied by hand
+	if flags.Changed("verbose") {
+		serverConfig.Verbose = util.Verbose
+	}
+	util.Verbose = serverConfig.Verbose
+	return nil
+}
+
 var ServerCmd = &cobra.Command{
 	Use: "server",
 	Run: func(cmd *cobra.Command, args []string) {
+		if err := loadServerConfiguration(cmd.Flags()); err != nil {
+			log.Fatal(err)
+		}
+
+		if err := serverConfig.Validate(); err != nil {
+			log.Fatalf("invalid configuration. error: %v", err)
+		}
+
 		theServer := server.NewServer(serverConfig)
 		theServer.StartAndServe()
 	},
 }
 
 var BucketCreateCmd = &cobra.Command{
-	Use: "create",
+	Use:  "create [bucket name]",
+	Args: cobra.MaximumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
+		// the server picks a name when none is given
+		bucketName := ""
+		if len(args) > 0 {
+			bucketName = args[0]
+		}
 
 		bucketSize, _ := cmd.Flags().GetInt64("size")
 		if bucketSize <= 0 {
 			fmt.Fprintf(os.Stderr, "required bucket size > 0 got size:%d\n", bucketSize)
 			os.Exit(1)
 		}
+		ttl, _ := cmd.Flags().GetDuration("ttl")
+		if ttl < 0 {
+			log.Fatalf("ttl must not be negative got:%v", ttl)
+		}
 
-		client := client.NewClient(clientConfig)
-		err := client.Connect()
+		ctx, cancel := commandContext()
+		defer cancel()
+		client := newClient()
+		err := client.Connect(ctx)
 		if err != nil {
 			log.Fatal(err)
 		}
-		bucketIdentifier, err := client.CreateBucket(bucketSize)
+		bucketIdentifier, err := client.CreateBucket(ctx, bucketName, bucketSize, ttl)
+		if message, ok := quotaExceededMessage(err); ok {
+			log.Fatalf("cannot create a %d byte bucket, quota exceeded: %s", bucketSize, message)
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -105,17 +329,259 @@ var BucketCreateCmd = &cobra.Command{
 	},
 }
 
+// quotaExceededMessage the reason the server gave for refusing a request
+// over quota
+func quotaExceededMessage(err error) (string, bool) {
+	var serverError *client.ServerError
+	if !errors.As(err, &serverError) || serverError.ErrorCode != util.ErrorCodeQuotaExceeded {
+		return "", false
+	}
+	return serverError.Message, true
+}
+
+var BucketExtendCmd = &cobra.Command{
+	Use:   "extend <bucket name>",
+	Short: "change when a bucket expires",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ttl, _ := cmd.Flags().GetDuration("ttl")
+		if ttl < 0 {
+			log.Fatalf("ttl must not be negative got:%v", ttl)
+		}
+
+		ctx, cancel := commandContext()
+		defer cancel()
+		client := newClient()
+		err := client.Connect(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		expiresAt, err := client.ExtendBucket(ctx, args[0], ttl)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if expiresAt.IsZero() {
+			fmt.Printf("bucket:%s never expires\n", args[0])
+			return
+		}
+		fmt.Printf("bucket:%s expires:%s\n", args[0], expiresAt.Format(time.RFC3339))
+	},
+}
+
 var BucketDeleteCmd = &cobra.Command{
 	Use: "delete",
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("delete TODO")
+		bucketName, _ := cmd.Flags().GetString("bucket-name")
+		if bucketName == "" && len(args) > 0 {
+			bucketName = args[0]
+		}
+		if bucketName == "" {
+			log.Fatalf("bucket-name is required")
+		}
+
+		ctx, cancel := commandContext()
+		defer cancel()
+		client := newClient()
+		err := client.Connect(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = client.DeleteBucket(ctx, bucketName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("deleted bucket:%s\n", bucketName)
+	},
+}
+
+// commandContext is cancelled by an interrupt or once --timeout has passed
+func commandContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	if commandTimeout <= 0 {
+		return ctx, cancel
+	}
+	timeoutCtx, cancelTimeout := context.WithTimeout(ctx, commandTimeout)
+	return timeoutCtx, func() {
+		cancelTimeout()
+		cancel()
+	}
+}
+
+// newClient logs what the client does to stderr like the rest of the cli
+func newClient() client.LoftClient {
+	return client.NewClient(clientConfig, client.WithLogger(log.New(os.Stderr, "", log.LstdFlags)))
+}
+
+// downloadRange writes part of a bucket to outputFile or to stdout for -
+func downloadRange(ctx context.Context, loftClient client.LoftClient, bucketName string, outputFile string, offset int64, length int64) error {
+	if outputFile == "-" {
+		return loftClient.PutBucketRangeInWriter(ctx, bucketName, os.Stdout, offset, length)
+	}
+	f, err := os.Create(outputFile)
+	if err != nil {
+		return errors.Wrapf(err, "failure opening file %s", outputFile)
+	}
+	defer f.Close()
+	if err := loftClient.PutBucketRangeInWriter(ctx, bucketName, f, offset, length); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "failure closing file %s", outputFile)
+	}
+	return nil
+}
+
+// uploadWithResume uploads through an upload session whose id is kept in a
+// state file so that running the same upload again continues it
+func uploadWithResume(ctx context.Context, loftClient client.LoftClient, bucketName string, inputFile string) error {
+	stateFilePath, err := client.UploadStateFilePath(clientConfig.ServerAddrAndPort, bucketName, inputFile)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(inputFile)
+	if err != nil {
+		return errors.Wrapf(err, "failure opening file %s", inputFile)
+	}
+
+	state, err := client.LoadUploadState(stateFilePath)
+	if err != nil {
+		return err
+	}
+	if state != nil && state.Matches(fi) {
+		err := loftClient.ResumeUploadSession(ctx, state.SessionID, inputFile)
+		if err == nil {
+			return client.RemoveUploadState(stateFilePath)
+		}
+		if !errors.Is(err, client.ErrUploadSessionNotFound) {
+			return err
+		}
+		log.Printf("upload session %s is gone, starting over", state.SessionID)
+	}
+
+	sessionID, err := loftClient.StartUploadSession(ctx, bucketName, inputFile)
+	if err != nil {
+		return err
+	}
+	state = &client.UploadState{
+		SessionID: sessionID,
+		Server:    clientConfig.ServerAddrAndPort,
+		Bucket:    bucketName,
+		FilePath:  inputFile,
+		Size:      fi.Size(),
+		ModTime:   fi.ModTime(),
+	}
+	if err := state.Save(stateFilePath); err != nil {
+		return err
+	}
+	if err := loftClient.ResumeUploadSession(ctx, sessionID, inputFile); err != nil {
+		return err
+	}
+	return client.RemoveUploadState(stateFilePath)
+}
+
+func printJSON(v interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func formatExpiry(expiresAt *time.Time) string {
+	if expiresAt == nil {
+		return "never"
+	}
+	return expiresAt.Format(time.RFC3339)
+}
+
+var BucketInfoCmd = &cobra.Command{
+	Use:   "info <bucket name>",
+	Short: "show a bucket without downloading it",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		if output != "table" && output != "json" {
+			log.Fatalf("output must be table or json got:%s", output)
+		}
+
+		ctx, cancel := commandContext()
+		defer cancel()
+		client := newClient()
+		err := client.Connect(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		bucket, err := client.StatBucket(ctx, args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if output == "json" {
+			printJSON(bucket)
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "name:\t%s\n", bucket.Name)
+		fmt.Fprintf(w, "capacity:\t%d\n", bucket.Capacity)
+		fmt.Fprintf(w, "used:\t%d\n", bucket.Size)
+		fmt.Fprintf(w, "created:\t%s\n", bucket.CreatedAt.Format(time.RFC3339))
+		fmt.Fprintf(w, "modified:\t%s\n", bucket.ModifiedAt.Format(time.RFC3339))
+		fmt.Fprintf(w, "expires:\t%s\n", formatExpiry(bucket.ExpiresAt))
+		fmt.Fprintf(w, "owner:\t%s\n", bucket.Owner)
+		fmt.Fprintf(w, "content type:\t%s\n", bucket.ContentType)
+		fmt.Fprintf(w, "checksum:\t%s\n", bucket.Checksum)
+		w.Flush()
+	},
+}
+
+var BucketListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the buckets on the server",
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		if output != "table" && output != "json" {
+			log.Fatalf("output must be table or json got:%s", output)
+		}
+
+		ctx, cancel := commandContext()
+		defer cancel()
+		client := newClient()
+		err := client.Connect(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		buckets, err := client.ListBuckets(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if output == "json" {
+			printJSON(buckets)
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tCAPACITY\tUSED\tCREATED\tMODIFIED\tEXPIRES")
+		for _, bucket := range buckets {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\n", bucket.Name, bucket.Capacity, bucket.Size,
+				bucket.CreatedAt.Format(time.RFC3339), bucket.ModifiedAt.Format(time.RFC3339), formatExpiry(bucket.ExpiresAt))
+		}
+		w.Flush()
 	},
 }
 
 var BucketDownloadCmd = &cobra.Command{
-	Use: "download",
+	Use:  "download [bucket name]",
+	Args: cobra.MaximumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		bucketName, _ := cmd.Flags().GetString("bucket-name")
+		if bucketName == "" && len(args) > 0 {
+			bucketName = args[0]
+		}
 		if bucketName == "" {
 			log.Fatalf("bucket-name is required")
 		}
@@ -125,10 +591,34 @@ var BucketDownloadCmd = &cobra.Command{
 			log.Fatalf("output-file is required")
 		}
 
-		client := client.NewClient(clientConfig)
-		err := client.Connect()
+		verify, _ := cmd.Flags().GetBool("verify")
+		resume, _ := cmd.Flags().GetBool("resume")
+		offset, _ := cmd.Flags().GetInt64("offset")
+		length, _ := cmd.Flags().GetInt64("length")
+		ranged := cmd.Flags().Changed("offset") || cmd.Flags().Changed("length")
+		if ranged && resume {
+			log.Fatalf("resume cannot be combined with offset or length")
+		}
+		if outputFile == "-" && resume {
+			log.Fatalf("resume cannot be combined with downloading to stdout")
+		}
+
+		ctx, cancel := commandContext()
+		defer cancel()
+		client := newClient()
+		err := client.Connect(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
 
-		err = client.PutBucketInFile(bucketName, outputFile)
+		switch {
+		case ranged:
+			err = downloadRange(ctx, client, bucketName, outputFile, offset, length)
+		case outputFile == "-":
+			err = client.PutBucketInWriter(ctx, bucketName, os.Stdout, verify)
+		default:
+			err = client.PutBucketInFile(ctx, bucketName, outputFile, verify, resume)
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -136,9 +626,13 @@ var BucketDownloadCmd = &cobra.Command{
 }
 
 var BucketUploadCmd = &cobra.Command{
-	Use: "upload",
+	Use:  "upload [bucket name]",
+	Args: cobra.MaximumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		bucketName, _ := cmd.Flags().GetString("bucket-name")
+		if bucketName == "" && len(args) > 0 {
+			bucketName = args[0]
+		}
 		if bucketName == "" {
 			log.Fatalf("bucket-name is required")
 		}
@@ -148,10 +642,26 @@ var BucketUploadCmd = &cobra.Command{
 			log.Fatalf("input-file is required")
 		}
 
-		client := client.NewClient(clientConfig)
-		err := client.Connect()
+		resume, _ := cmd.Flags().GetBool("resume")
 
-		_, err = client.PutFileInBucket(bucketName, inputFile)
+		ctx, cancel := commandContext()
+		defer cancel()
+		client := newClient()
+		err := client.Connect(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		switch {
+		case inputFile == "-" && resume:
+			log.Fatalf("resume cannot be combined with uploading from stdin")
+		case inputFile == "-":
+			err = client.PutReaderInBucket(ctx, bucketName, os.Stdin, "application/octet-stream")
+		case resume:
+			err = uploadWithResume(ctx, client, bucketName, inputFile)
+		default:
+			err = client.PutFileInBucket(ctx, bucketName, inputFile)
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -160,6 +670,23 @@ var BucketUploadCmd = &cobra.Command{
 
 var BucketCmd = &cobra.Command{
 	Use: "bucket",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		configFilePath, configFile, err := openClientConfigFile()
+		if err != nil {
+			log.Fatal(err)
+		}
+		profile, ok := configFile.Profile(clientProfileName)
+		if !ok && clientProfileName != "" {
+			log.Fatalf("no profile named %s in %s", clientProfileName, configFilePath)
+		}
+		err = loadWithFlagPrecedence(cmd.Flags(), func() error {
+			clientConfig.Merge(profile)
+			return nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println("bucket")
 	},
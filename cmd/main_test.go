@@ -0,0 +1,251 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/genesis32/loft/client"
+	"github.com/genesis32/loft/server"
+	"github.com/genesis32/loft/util"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// serverTestFlags a few of the server command's flags, bound to the same
+// variables but without the state left behind by other tests
+func serverTestFlags(t *testing.T) *pflag.FlagSet {
+	t.Helper()
+	serverConfig = server.ServerConfiguration{}
+	t.Cleanup(func() {
+		serverConfig = server.ServerConfiguration{}
+		serverConfigFilePath = ""
+		util.Verbose = false
+	})
+	flags := pflag.NewFlagSet("server", pflag.ContinueOnError)
+	flags.StringVarP(&serverConfig.ListenAddrAndPort, "listen", "l", ":8089", "")
+	flags.DurationVar(&serverConfig.IdleTimeout, "idle-timeout", 5*time.Minute, "")
+	flags.BoolVarP(&util.Verbose, "verbose", "v", false, "")
+	return flags
+}
+
+func TestServerFlagsOverrideConfigFile(t *testing.T) {
+	configFilePath := filepath.Join(t.TempDir(), "server.yaml")
+	configYaml := "listen: 127.0.0.1:9000\nidle_timeout: 7m\nverbose: true\n"
+	if err := ioutil.WriteFile(configFilePath, []byte(configYaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		args        []string
+		listen      string
+		idleTimeout time.Duration
+		verbose     bool
+	}{
+		{"file", nil, "127.0.0.1:9000", 7 * time.Minute, true},
+		{"flags", []string{"--listen", "127.0.0.1:9001", "--verbose=false"}, "127.0.0.1:9001", 7 * time.Minute, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flags := serverTestFlags(t)
+			if err := flags.Parse(test.args); err != nil {
+				t.Fatal(err)
+			}
+			serverConfigFilePath = configFilePath
+			if err := loadServerConfiguration(flags); err != nil {
+				t.Fatal(err)
+			}
+			if serverConfig.ListenAddrAndPort != test.listen || serverConfig.IdleTimeout != test.idleTimeout {
+				t.Fatalf("expected listen %s idle timeout %v got %s %v",
+					test.listen, test.idleTimeout, serverConfig.ListenAddrAndPort, serverConfig.IdleTimeout)
+			}
+			if serverConfig.Verbose != test.verbose || util.Verbose != test.verbose {
+				t.Fatalf("expected verbose %v got config:%v util:%v", test.verbose, serverConfig.Verbose, util.Verbose)
+			}
+		})
+	}
+}
+
+func TestVerboseFlagWithoutConfigFile(t *testing.T) {
+	flags := serverTestFlags(t)
+	if err := flags.Parse([]string{"-v"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadServerConfiguration(flags); err != nil {
+		t.Fatal(err)
+	}
+	if !serverConfig.Verbose || !util.Verbose {
+		t.Fatalf("expected the verbose flag to stick got config:%v util:%v", serverConfig.Verbose, util.Verbose)
+	}
+}
+
+// chdir changes the working directory until the test ends
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestSetSavesAbsolutePaths(t *testing.T) {
+	dir := t.TempDir()
+	chdir(t, dir)
+	configFilePath := filepath.Join(dir, "config", "config.yaml")
+	t.Cleanup(func() {
+		clientConfigFilePath = ""
+		clientProfileName = ""
+	})
+	RootCmd.SetArgs([]string{"set", "example.com:8089", "--client-config", configFilePath, "--profile", "work",
+		"--cert", "ca.pem", "--identity-cert", "certs/me.pem", "--identity-key", "/etc/loft/me.key"})
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the profile is read back from somewhere else
+	chdir(t, t.TempDir())
+	configFile, err := client.LoadConfigFile(configFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, ok := configFile.Profile("")
+	if !ok {
+		t.Fatalf("expected the work profile to be current got %#v", configFile)
+	}
+	expected := client.ClientConfiguration{
+		ServerAddrAndPort:       "example.com:8089",
+		SslClientCertFilePath:   filepath.Join(wd, "ca.pem"),
+		SslIdentityCertFilePath: filepath.Join(wd, "certs", "me.pem"),
+		SslIdentityKeyFilePath:  "/etc/loft/me.key",
+	}
+	if profile != expected {
+		t.Fatalf("expected %#v got %#v", expected, profile)
+	}
+
+	savedFilePath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := configFile.Save(savedFilePath); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := client.LoadConfigFile(savedFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reloaded, configFile) {
+		t.Fatalf("config changed in a round trip\nsaved:    %#v\nreloaded: %#v", configFile, reloaded)
+	}
+}
+
+// resumeTestClient a client whose upload sessions are interrupted on demand
+type resumeTestClient struct {
+	client.LoftClient
+	sessions  int
+	open      map[string]bool
+	interrupt bool
+	resumed   []string
+}
+
+func (c *resumeTestClient) StartUploadSession(ctx context.Context, bucketIdentifier string, filePath string) (string, error) {
+	c.sessions++
+	sessionID := fmt.Sprintf("session%d", c.sessions)
+	c.open[sessionID] = true
+	return sessionID, nil
+}
+
+func (c *resumeTestClient) ResumeUploadSession(ctx context.Context, sessionID string, filePath string) error {
+	c.resumed = append(c.resumed, sessionID)
+	if !c.open[sessionID] {
+		return errors.Wrap(client.ErrUploadSessionNotFound, "cannot read upload session")
+	}
+	if c.interrupt {
+		return errors.New("connection reset")
+	}
+	delete(c.open, sessionID)
+	return nil
+}
+
+func TestUploadWithResumeContinuesInterruptedSession(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	inputFile := filepath.Join(t.TempDir(), "upload.txt")
+	if err := ioutil.WriteFile(inputFile, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stateFilePath, err := client.UploadStateFilePath(clientConfig.ServerAddrAndPort, "foo", inputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	c := &resumeTestClient{open: map[string]bool{}, interrupt: true}
+
+	if err := uploadWithResume(ctx, c, "foo", inputFile); err == nil {
+		t.Fatal("expected the interrupted upload to fail")
+	}
+	state, err := client.LoadUploadState(stateFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state == nil || state.SessionID != "session1" || state.Bucket != "foo" || state.Size != 5 {
+		t.Fatalf("expected the interrupted session to be remembered got %#v", state)
+	}
+
+	c.interrupt = false
+	if err := uploadWithResume(ctx, c, "foo", inputFile); err != nil {
+		t.Fatal(err)
+	}
+	if c.sessions != 1 || len(c.resumed) != 2 || c.resumed[1] != "session1" {
+		t.Fatalf("expected session1 to be resumed got %d sessions resuming %v", c.sessions, c.resumed)
+	}
+	if state, err := client.LoadUploadState(stateFilePath); err != nil || state != nil {
+		t.Fatalf("expected the state to be removed once committed got %#v error: %v", state, err)
+	}
+}
+
+func TestUploadWithResumeStartsOver(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, c *resumeTestClient, inputFile string)
+	}{
+		{"session expired", func(t *testing.T, c *resumeTestClient, inputFile string) {
+			delete(c.open, "session1")
+		}},
+		{"file changed", func(t *testing.T, c *resumeTestClient, inputFile string) {
+			if err := ioutil.WriteFile(inputFile, []byte("hello world"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("XDG_CACHE_HOME", t.TempDir())
+			inputFile := filepath.Join(t.TempDir(), "upload.txt")
+			if err := ioutil.WriteFile(inputFile, []byte("hello"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			c := &resumeTestClient{open: map[string]bool{}, interrupt: true}
+			uploadWithResume(ctx, c, "foo", inputFile)
+
+			test.change(t, c, inputFile)
+			c.interrupt = false
+			if err := uploadWithResume(ctx, c, "foo", inputFile); err != nil {
+				t.Fatal(err)
+			}
+			if c.sessions != 2 {
+				t.Fatalf("expected a new session got %d sessions resuming %v", c.sessions, c.resumed)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/genesis32/loft/storage"
+	"github.com/genesis32/loft/util"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	StorageBackendFilesystem = "filesystem"
+	StorageBackendMemory     = "memory"
+)
+
+// LoadConfiguration reads a yaml server configuration file over the values
+// already in config. A file looks like
+//
+//	listen: ":8089"
+//	storage_backend: filesystem
+//	bucket_path: /var/lib/loft/buckets
+//	cert: /etc/loft/server.pem
+//	key: /etc/loft/server.key
+//	client_ca: /etc/loft/ca.pem
+//	max_bucket_size: 1073741824
+//	log_file: /var/log/loft.log
+//	verbose: false
+//	upload_session_idle_timeout: 1h
+//	max_upload_sessions_per_owner: 16
+//	idle_timeout: 5m
+//	header_read_timeout: 30s
+//	transfer_timeout: 1m
+//	bucket_name_length: 16
+//	expiry_sweep_interval: 1m
+//	expiry_grace_period: 24h
+//	quota: 107374182400
+//	owner_quota: 10737418240
+//	owner_quotas:
+//	  "CN=ci,O=example": 53687091200
+//	min_free_space: 1073741824
+func LoadConfiguration(configFilePath string, config *ServerConfiguration) error {
+	configBytes, err := ioutil.ReadFile(configFilePath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read config file %s", configFilePath)
+	}
+	if err := yaml.UnmarshalStrict(configBytes, config); err != nil {
+		return errors.Wrapf(err, "failed to parse config file %s", configFilePath)
+	}
+	return nil
+}
+
+// Validate checks the configuration before the server starts listening
+func (c ServerConfiguration) Validate() error {
+	if _, _, err := net.SplitHostPort(c.ListenAddrAndPort); err != nil {
+		return errors.Wrapf(err, "invalid listen address '%s'", c.ListenAddrAndPort)
+	}
+
+	switch c.StorageBackend {
+	case "", StorageBackendFilesystem:
+		if strings.TrimSpace(c.BucketPath) == "" {
+			return errors.New("bucket path is required")
+		}
+		stat, err := os.Stat(c.BucketPath)
+		if err != nil {
+			return errors.Wrap(err, "invalid bucket path")
+		}
+		if !stat.IsDir() {
+			return errors.Errorf("bucket path: %s is not a directory", c.BucketPath)
+		}
+	case StorageBackendMemory:
+	default:
+		return errors.Errorf("unknown storage backend '%s' expected %s or %s", c.StorageBackend, StorageBackendFilesystem, StorageBackendMemory)
+	}
+
+	keyFilePath := strings.TrimSpace(c.SslClientKeyFilePath)
+	certFilePath := strings.TrimSpace(c.SslClientCertFilePath)
+	if (keyFilePath == "") != (certFilePath == "") {
+		return errors.New("both a key and a cert are required to serve tls")
+	}
+	if strings.TrimSpace(c.SslClientCAFilePath) != "" && certFilePath == "" {
+		return errors.New("a client ca requires the server to serve tls")
+	}
+	for _, filePath := range []string{keyFilePath, certFilePath, c.SslClientCAFilePath} {
+		if strings.TrimSpace(filePath) == "" {
+			continue
+		}
+		if _, err := os.Stat(filePath); err != nil {
+			return errors.Wrap(err, "invalid tls file")
+		}
+	}
+
+	if c.MaxBucketSize < 0 {
+		return errors.Errorf("max bucket size must not be negative got:%d", c.MaxBucketSize)
+	}
+	if c.UploadSessionIdleTimeout <= 0 {
+		return errors.Errorf("upload session idle timeout must be positive got:%v", c.UploadSessionIdleTimeout)
+	}
+	if c.MaxUploadSessionsPerOwner < 0 {
+		return errors.Errorf("max upload sessions per owner must not be negative got:%d", c.MaxUploadSessionsPerOwner)
+	}
+	if c.BucketNameLength < util.MinBucketNameLength || c.BucketNameLength > util.MaxBucketNameLength {
+		return errors.Errorf("bucket name length must be %d to %d got:%d", util.MinBucketNameLength, util.MaxBucketNameLength, c.BucketNameLength)
+	}
+	if c.IdleTimeout <= 0 {
+		return errors.Errorf("idle timeout must be positive got:%v", c.IdleTimeout)
+	}
+	if c.HeaderReadTimeout <= 0 {
+		return errors.Errorf("header read timeout must be positive got:%v", c.HeaderReadTimeout)
+	}
+	if c.TransferTimeout <= 0 {
+		return errors.Errorf("transfer timeout must be positive got:%v", c.TransferTimeout)
+	}
+	if c.ExpirySweepInterval <= 0 {
+		return errors.Errorf("expiry sweep interval must be positive got:%v", c.ExpirySweepInterval)
+	}
+	if c.ExpiryGracePeriod < 0 {
+		return errors.Errorf("expiry grace period must not be negative got:%v", c.ExpiryGracePeriod)
+	}
+	if c.Quota < 0 {
+		return errors.Errorf("quota must not be negative got:%d", c.Quota)
+	}
+	if c.OwnerQuota < 0 {
+		return errors.Errorf("owner quota must not be negative got:%d", c.OwnerQuota)
+	}
+	for owner, quota := range c.OwnerQuotas {
+		if quota < 0 {
+			return errors.Errorf("quota of '%s' must not be negative got:%d", owner, quota)
+		}
+	}
+	if c.MinFreeSpace < 0 {
+		return errors.Errorf("min free space must not be negative got:%d", c.MinFreeSpace)
+	}
+	return nil
+}
+
+// newBackend opens the storage backend selected by the configuration
+func newBackend(c ServerConfiguration) (storage.Backend, error) {
+	switch c.StorageBackend {
+	case "", StorageBackendFilesystem:
+		log.Printf("using bucket path: %s", c.BucketPath)
+		return storage.NewFilesystemBackend(c.BucketPath)
+	case StorageBackendMemory:
+		log.Print("using in memory storage. buckets are lost when the server exits")
+		return storage.NewMemoryBackend(), nil
+	}
+	return nil, errors.Errorf("unknown storage backend '%s'", c.StorageBackend)
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes configYaml to a file and returns its path
+func writeConfigFile(t *testing.T, configYaml string) string {
+	t.Helper()
+	configFilePath := filepath.Join(t.TempDir(), "server.yaml")
+	if err := ioutil.WriteFile(configFilePath, []byte(configYaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return configFilePath
+}
+
+func TestLoadConfigurationKeepsUnsetValues(t *testing.T) {
+	configFilePath := writeConfigFile(t, "listen: 127.0.0.1:9000\nverbose: true\nowner_quotas:\n  CN=ci: 100\n")
+	config := testConfiguration()
+	if err := LoadConfiguration(configFilePath, &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.ListenAddrAndPort != "127.0.0.1:9000" || !config.Verbose || config.OwnerQuotas["CN=ci"] != 100 {
+		t.Fatalf("values from the file were not loaded %#v", config)
+	}
+	if config.IdleTimeout != time.Minute || config.StorageBackend != StorageBackendMemory {
+		t.Fatalf("values missing from the file were changed %#v", config)
+	}
+}
+
+func TestLoadConfigurationRefusesUnknownKeys(t *testing.T) {
+	configFilePath := writeConfigFile(t, "listen: 127.0.0.1:9000\nlisten_port: 9000\n")
+	config := testConfiguration()
+	err := LoadConfiguration(configFilePath, &config)
+	if err == nil || !strings.Contains(err.Error(), "listen_port") {
+		t.Fatalf("expected the unknown key to be refused got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	certFilePath, keyFilePath := writeSelfSignedCert(t, t.TempDir(), "server")
+	tests := []struct {
+		name     string
+		change   func(c *ServerConfiguration)
+		expected string
+	}{
+		{"test configuration", func(c *ServerConfiguration) {}, ""},
+		{"key and cert", func(c *ServerConfiguration) {
+			c.SslClientCertFilePath, c.SslClientKeyFilePath = certFilePath, keyFilePath
+		}, ""},
+		{"only key", func(c *ServerConfiguration) { c.SslClientKeyFilePath = keyFilePath }, "both a key and a cert"},
+		{"only cert", func(c *ServerConfiguration) { c.SslClientCertFilePath = certFilePath }, "both a key and a cert"},
+		{"client ca without tls", func(c *ServerConfiguration) { c.SslClientCAFilePath = certFilePath }, "client ca requires"},
+		{"missing cert file", func(c *ServerConfiguration) {
+			c.SslClientCertFilePath, c.SslClientKeyFilePath = certFilePath+".missing", keyFilePath
+		}, "invalid tls file"},
+		{"bad listen address", func(c *ServerConfiguration) { c.ListenAddrAndPort = "8089" }, "invalid listen address"},
+		{"unknown storage", func(c *ServerConfiguration) { c.StorageBackend = "tape" }, "unknown storage backend"},
+		{"filesystem without bucket path", func(c *ServerConfiguration) {
+			c.StorageBackend = StorageBackendFilesystem
+		}, "bucket path is required"},
+		{"bucket path not a directory", func(c *ServerConfiguration) {
+			c.StorageBackend, c.BucketPath = StorageBackendFilesystem, certFilePath
+		}, "is not a directory"},
+		{"short bucket names", func(c *ServerConfiguration) { c.BucketNameLength = 1 }, "bucket name length"},
+		{"no idle timeout", func(c *ServerConfiguration) { c.IdleTimeout = 0 }, "idle timeout"},
+		{"negative owner quota", func(c *ServerConfiguration) {
+			c.OwnerQuotas = map[string]int64{"CN=ci": -1}
+		}, "quota of 'CN=ci'"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfiguration()
+			test.change(&config)
+			err := config.Validate()
+			if test.expected == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.expected) {
+				t.Fatalf("expected an error containing %q got: %v", test.expected, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net"
+	"time"
+)
+
+// deadlineConn pushes the deadline of the connection back before every read
+// or write while a timeout is set, so a transfer only times out once it
+// stalls rather than after a fixed time however large it is
+type deadlineConn struct {
+	net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	if c.readTimeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	return c.Conn.Write(p)
+}
+
+// awaitRequest waits up to the idle timeout for the next request to start
+// arriving and then gives the client the header read timeout to send the
+// rest of its frame
+func (c *ServerConnection) awaitRequest(config ServerConfiguration) error {
+	c.deadlines.readTimeout = 0
+	c.theConn.SetReadDeadline(time.Now().Add(config.IdleTimeout))
+	if _, err := c.bufferedReader.Peek(1); err != nil {
+		return err
+	}
+	c.theConn.SetReadDeadline(time.Now().Add(config.HeaderReadTimeout))
+	return nil
+}
+
+// startTransfer lets the request being handled read for as long as bytes keep
+// arriving within the transfer timeout
+func (c *ServerConnection) startTransfer(config ServerConfiguration) {
+	c.deadlines.readTimeout = config.TransferTimeout
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/genesis32/loft/storage"
+	"github.com/genesis32/loft/util"
+)
+
+// expectClosed fails unless the server closes conn within limit
+func expectClosed(t *testing.T, conn net.Conn, limit time.Duration) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(limit))
+	if _, err := io.Copy(ioutil.Discard, conn); err != nil {
+		t.Fatalf("server did not close the stalled connection. error: %v", err)
+	}
+}
+
+func TestIdleConnectionClosed(t *testing.T) {
+	config := testConfiguration()
+	config.IdleTimeout = 100 * time.Millisecond
+	_, addr := startTestServer(t, config, storage.NewMemoryBackend())
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expectClosed(t, conn, 5*time.Second)
+}
+
+func TestStalledHeaderClosed(t *testing.T) {
+	config := testConfiguration()
+	config.HeaderReadTimeout = 100 * time.Millisecond
+	_, addr := startTestServer(t, config, storage.NewMemoryBackend())
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the start of a frame ends the idle wait, the rest never comes
+	if _, err := conn.Write([]byte("LOF")); err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(t, conn, 5*time.Second)
+}
+
+// startUpload creates a bucket of capacity bytes and starts uploading numBytes
+// to it, returning its name
+func startUpload(t *testing.T, c *version1Conn, capacity int64, numBytes int64) string {
+	t.Helper()
+	c.send(util.BucketGenerateRequest{Header: c.header(util.BucketGenerateMessageType), NumBytesInBucket: capacity})
+	generated, ok := c.receive().(util.BucketGenerateResponse)
+	if !ok || generated.ErrorCode != util.ErrorCodeNone {
+		t.Fatalf("failed to create a bucket got %#v", generated)
+	}
+	c.send(util.BucketPutBytesRequest{Header: c.header(util.BucketPutBytesMessageType),
+		UniqueIdentifier: generated.UniqueIdentifier, NumBytes: numBytes})
+	if put, ok := c.receive().(util.BucketPutBytesResponse); !ok || put.ErrorCode != util.ErrorCodeNone {
+		t.Fatalf("upload refused got %#v", put)
+	}
+	return generated.UniqueIdentifier
+}
+
+func TestStalledUploadClosed(t *testing.T) {
+	config := testConfiguration()
+	config.TransferTimeout = 100 * time.Millisecond
+	backend := storage.NewMemoryBackend()
+	_, addr := startTestServer(t, config, backend)
+	c := dialVersion1(t, addr)
+
+	name := startUpload(t, c, 10, 10)
+	if _, err := c.conn.Write([]byte("hel")); err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(t, c.conn, 5*time.Second)
+
+	metadata, err := backend.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.ContentLength != 0 {
+		t.Fatalf("stalled upload was committed with %d bytes", metadata.ContentLength)
+	}
+}
+
+func TestSlowUploadOutlastsTransferTimeout(t *testing.T) {
+	config := testConfiguration()
+	config.TransferTimeout = 200 * time.Millisecond
+	backend := storage.NewMemoryBackend()
+	_, addr := startTestServer(t, config, backend)
+	c := dialVersion1(t, addr)
+
+	// takes longer than the transfer timeout in all but never stalls for it
+	name := startUpload(t, c, 10, 10)
+	for i := 0; i < 10; i++ {
+		if _, err := c.conn.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	c.send(util.BucketStatRequest{Header: c.header(util.BucketStatMessageType), UniqueIdentifier: name})
+	stat, ok := c.receive().(util.BucketStatResponse)
+	if !ok || stat.ErrorCode != util.ErrorCodeNone || stat.Bucket.Size != 10 {
+		t.Fatalf("slow upload did not complete got %#v", stat)
+	}
+}
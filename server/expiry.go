@@ -0,0 +1,109 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/genesis32/loft/storage"
+	"github.com/genesis32/loft/util"
+)
+
+// expiresAt when a bucket given timeToLive nanoseconds at now expires, the
+// zero time for never
+func expiresAt(now time.Time, timeToLive int64) time.Time {
+	if timeToLive == 0 {
+		return time.Time{}
+	}
+	return now.Add(time.Duration(timeToLive))
+}
+
+func expiresAtUnixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func bucketExpired(metadata storage.Metadata, now time.Time) bool {
+	return !metadata.ExpiresAt.IsZero() && !now.Before(metadata.ExpiresAt)
+}
+
+// sweepExpiredBuckets deletes every bucket whose grace period ended before now
+func (s *Server) sweepExpiredBuckets(now time.Time) {
+	uniqueIdentifiers, err := s.backend.List()
+	if err != nil {
+		log.Printf("failed to list buckets to expire. error: %v", err)
+		return
+	}
+	for _, uniqueIdentifier := range uniqueIdentifiers {
+		s.expiryMu.Lock()
+		metadata, err := s.backend.Stat(uniqueIdentifier)
+		if err == nil && bucketExpired(metadata, now.Add(-s.config.ExpiryGracePeriod)) {
+			err = s.deleteBucket(uniqueIdentifier, metadata)
+			if err == nil {
+				log.Printf("deleted bucket %s which expired at %s", uniqueIdentifier, metadata.ExpiresAt.Format(time.RFC3339))
+			}
+		}
+		s.expiryMu.Unlock()
+		if err != nil && err != storage.ErrNotFound {
+			log.Printf("failed to expire bucket %s. error: %v", uniqueIdentifier, err)
+		}
+	}
+}
+
+// commitUpload commits new contents for a bucket without losing an expiry
+// set while they were being uploaded
+func (s *Server) commitUpload(uniqueIdentifier string, writer storage.Writer, metadata storage.Metadata) error {
+	s.expiryMu.Lock()
+	defer s.expiryMu.Unlock()
+	if current, err := s.backend.Stat(uniqueIdentifier); err == nil {
+		metadata.ExpiresAt = current.ExpiresAt
+	}
+	return writer.Commit(metadata)
+}
+
+func (s *Server) sweepExpiredBucketsForever() {
+	for now := range time.Tick(s.config.ExpirySweepInterval) {
+		s.sweepExpiredBuckets(now)
+	}
+}
+
+func (s *Server) bucketExtend2(clientConn *ServerConnection, request util.BucketExtendRequest) (util.BucketExtendResponse, error) {
+	bucketName, err := parseBucketName(request.UniqueIdentifier)
+	uniqueIdentifier := bucketName.String()
+	bucketExtendResponse := util.BucketExtendResponse{
+		Header:    clientConn.header(util.BucketExtendResponseMessageType),
+		ErrorCode: util.ErrorCodeNone,
+	}
+	if err != nil {
+		return bucketExtendResponse, err
+	}
+	if request.TimeToLive < 0 {
+		return bucketExtendResponse, newRequestError(util.ErrorCodeMalformedMessage, nil,
+			"time to live must not be negative got:%v", time.Duration(request.TimeToLive))
+	}
+
+	s.expiryMu.Lock()
+	defer s.expiryMu.Unlock()
+	// a bucket still in its grace period can be brought back
+	metadata, err := s.statBucketIncludingExpired(uniqueIdentifier, clientConn.owner)
+	if err != nil {
+		return bucketExtendResponse, err
+	}
+	metadata.ExpiresAt = expiresAt(time.Now(), request.TimeToLive)
+	err = s.backend.UpdateMetadata(uniqueIdentifier, metadata)
+	if err == storage.ErrNotFound {
+		return bucketExtendResponse, newRequestError(util.ErrorCodeBucketNotFound, nil, "bucket %s does not exist", uniqueIdentifier)
+	}
+	if err != nil {
+		return bucketExtendResponse, newRequestError(util.ErrorCodeIOFailure, err, "error updating bucket %s", uniqueIdentifier)
+	}
+	if metadata.ExpiresAt.IsZero() {
+		log.Printf("bucket %s no longer expires", uniqueIdentifier)
+	} else {
+		log.Printf("bucket %s now expires at %s", uniqueIdentifier, metadata.ExpiresAt.Format(time.RFC3339))
+	}
+
+	bucketExtendResponse.ExpiresAt = expiresAtUnixNano(metadata.ExpiresAt)
+	return bucketExtendResponse, nil
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/genesis32/loft/client"
+	"github.com/genesis32/loft/storage"
+	"github.com/pkg/errors"
+)
+
+// backdateExpiry makes a bucket look as if it expired ago
+func backdateExpiry(t *testing.T, backend storage.Backend, name string, ago time.Duration) {
+	t.Helper()
+	metadata, err := backend.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata.ExpiresAt = time.Now().Add(-ago)
+	if err := backend.UpdateMetadata(name, metadata); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpiredBucketKeptForGracePeriod(t *testing.T) {
+	backend := storage.NewMemoryBackend()
+	config := testConfiguration()
+	s, addr := startTestServer(t, config, backend)
+	ctx := context.Background()
+	c := connectTestClient(t, client.ClientConfiguration{ServerAddrAndPort: addr})
+	name, err := c.CreateBucket(ctx, "", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forever, err := c.CreateBucket(ctx, "", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := c.StatBucket(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ExpiresAt == nil || info.ExpiresAt.Before(time.Now()) || info.ExpiresAt.After(time.Now().Add(time.Minute)) {
+		t.Fatalf("expected the bucket to expire within a minute got %v", info.ExpiresAt)
+	}
+
+	backdateExpiry(t, backend, name, time.Minute)
+	s.sweepExpiredBuckets(time.Now())
+	if _, err := c.StatBucket(ctx, name); !errors.Is(err, client.ErrBucketExpired) {
+		t.Fatalf("expected stat of the expired bucket to say so got %v", err)
+	}
+	if _, _, err := c.Download(ctx, name); !errors.Is(err, client.ErrBucketExpired) {
+		t.Fatalf("expected download of the expired bucket to say so got %v", err)
+	}
+	if err := c.Upload(ctx, name, strings.NewReader("hello"), 5); !errors.Is(err, client.ErrBucketExpired) {
+		t.Fatalf("expected upload to the expired bucket to say so got %v", err)
+	}
+
+	// the sweeper waits out the grace period after the bucket expired
+	s.sweepExpiredBuckets(time.Now().Add(config.ExpiryGracePeriod - 2*time.Minute))
+	if _, err := backend.Stat(name); err != nil {
+		t.Fatalf("expected the bucket to outlive its expiry by the grace period. error: %v", err)
+	}
+	s.sweepExpiredBuckets(time.Now().Add(config.ExpiryGracePeriod))
+	if _, err := c.StatBucket(ctx, name); !errors.Is(err, client.ErrBucketNotFound) {
+		t.Fatalf("expected the bucket to be swept once the grace period ended got %v", err)
+	}
+	if _, err := c.StatBucket(ctx, forever); err != nil {
+		t.Fatalf("expected the bucket without an expiry to stay. error: %v", err)
+	}
+}
+
+func TestExtendBucketPushesExpiryForward(t *testing.T) {
+	backend := storage.NewMemoryBackend()
+	config := testConfiguration()
+	s, addr := startTestServer(t, config, backend)
+	ctx := context.Background()
+	c := connectTestClient(t, client.ClientConfiguration{ServerAddrAndPort: addr})
+	name, err := c.CreateBucket(ctx, "", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a bucket in its grace period can still be brought back
+	backdateExpiry(t, backend, name, time.Minute)
+	expiresAt, err := c.ExtendBucket(ctx, name, 3*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiresAt.Before(time.Now().Add(2 * time.Hour)) {
+		t.Fatalf("expected the bucket to expire in 3 hours got %v", expiresAt)
+	}
+	info, err := c.StatBucket(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ExpiresAt == nil || !info.ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("expected the bucket to expire at %v got %v", expiresAt, info.ExpiresAt)
+	}
+	s.sweepExpiredBuckets(time.Now().Add(config.ExpiryGracePeriod))
+	if _, err := backend.Stat(name); err != nil {
+		t.Fatalf("expected the extended bucket to survive the sweep. error: %v", err)
+	}
+
+	if _, err := c.ExtendBucket(ctx, name, 0); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := c.StatBucket(ctx, name); err != nil || info.ExpiresAt != nil {
+		t.Fatalf("expected the bucket to no longer expire got %v error: %v", info.ExpiresAt, err)
+	}
+}
+
+func TestCommitKeepsExpirySetDuringUpload(t *testing.T) {
+	backend := storage.NewMemoryBackend()
+	s, addr := startTestServer(t, testConfiguration(), backend)
+	ctx := context.Background()
+	c := connectTestClient(t, client.ClientConfiguration{ServerAddrAndPort: addr})
+	name, filePath := sessionTestUpload(t, c, "hello world")
+	sessionID, err := c.StartUploadSession(ctx, name, filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendChunk(t, s, sessionID, 0, "hello")
+
+	expiresAt, err := c.ExtendBucket(ctx, name, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ResumeUploadSession(ctx, sessionID, filePath); err != nil {
+		t.Fatal(err)
+	}
+	contents, metadata := readTestBucket(t, backend, name)
+	if contents != "hello world" || !metadata.ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("expected the upload to keep the expiry %v got %q %v", expiresAt, contents, metadata.ExpiresAt)
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/genesis32/loft/client"
+	"github.com/genesis32/loft/storage"
+	"github.com/genesis32/loft/util"
+	"github.com/pkg/errors"
+)
+
+// collideBucketNames makes the first collisions generated names the name of
+// an existing bucket and returns how many names were generated so far
+func collideBucketNames(t *testing.T, taken util.BucketName, collisions int) func() int {
+	var mu sync.Mutex
+	calls := 0
+	generate := generateBucketName
+	generateBucketName = func(length int) (util.BucketName, error) {
+		mu.Lock()
+		calls++
+		call := calls
+		mu.Unlock()
+		if call <= collisions {
+			return taken, nil
+		}
+		return generate(length)
+	}
+	t.Cleanup(func() { generateBucketName = generate })
+	return func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls
+	}
+}
+
+func newTestFilesystemBackend(t *testing.T) *storage.FilesystemBackend {
+	t.Helper()
+	backend, err := storage.NewFilesystemBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+func TestConcurrentCreatesGetUniqueNames(t *testing.T) {
+	const clients = 50
+	const collisions = 4
+	backend := newTestFilesystemBackend(t)
+	taken, err := util.ParseBucketName("takenbucketname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Create(taken.String(), storage.Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+	calls := collideBucketNames(t, taken, collisions)
+	_, addr := startTestServer(t, testConfiguration(), backend)
+
+	names := make(chan string, clients)
+	errs := make(chan error, clients)
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		c := connectTestClient(t, client.ClientConfiguration{ServerAddrAndPort: addr})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name, err := c.CreateBucket(context.Background(), "", 10, 0)
+			if err != nil {
+				errs <- err
+				return
+			}
+			names <- name
+		}()
+	}
+	wg.Wait()
+	close(names)
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	unique := map[string]bool{taken.String(): true}
+	for name := range names {
+		if unique[name] {
+			t.Fatalf("bucket name %s handed out twice", name)
+		}
+		unique[name] = true
+	}
+	if len(unique) != clients+1 {
+		t.Fatalf("expected %d new buckets got %d", clients, len(unique)-1)
+	}
+	if calls() != clients+collisions {
+		t.Fatalf("expected the %d collisions to be retried, %d names generated for %d buckets", collisions, calls(), clients)
+	}
+	listed, err := backend.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != clients+1 {
+		t.Fatalf("expected %d buckets stored got %d", clients+1, len(listed))
+	}
+}
+
+func TestCreateGivesUpWithoutFreeName(t *testing.T) {
+	backend := newTestFilesystemBackend(t)
+	taken, err := util.ParseBucketName("takenbucketname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Create(taken.String(), storage.Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+	calls := collideBucketNames(t, taken, generateBucketNameAttempts)
+	_, addr := startTestServer(t, testConfiguration(), backend)
+
+	c := connectTestClient(t, client.ClientConfiguration{ServerAddrAndPort: addr})
+	if _, err := c.CreateBucket(context.Background(), "", 10, 0); !errors.Is(err, client.ErrInternal) {
+		t.Fatalf("expected an internal error got %v", err)
+	}
+	if calls() != generateBucketNameAttempts {
+		t.Fatalf("expected %d attempts got %d", generateBucketNameAttempts, calls())
+	}
+}
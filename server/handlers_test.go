@@ -0,0 +1,248 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/genesis32/loft/client"
+	"github.com/genesis32/loft/storage"
+	"github.com/genesis32/loft/util"
+	"github.com/pkg/errors"
+)
+
+func TestBucketLifecycle(t *testing.T) {
+	backend := storage.NewMemoryBackend()
+	_, addr := startTestServer(t, testConfiguration(), backend)
+	c := connectTestClient(t, client.ClientConfiguration{ServerAddrAndPort: addr})
+	ctx := context.Background()
+
+	name, err := c.CreateBucket(ctx, "", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PutReaderInBucket(ctx, name, strings.NewReader("hello"), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := backend.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Capacity != 10 || metadata.ContentLength != 5 || metadata.ContentType != "text/plain" || metadata.Checksum == "" {
+		t.Fatalf("unexpected metadata stored %#v", metadata)
+	}
+	info, err := c.StatBucket(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != name || info.Capacity != 10 || info.Size != 5 || info.ContentType != "text/plain" || info.Checksum != metadata.Checksum {
+		t.Fatalf("unexpected stat %#v", info)
+	}
+
+	var contents bytes.Buffer
+	if err := c.PutBucketInWriter(ctx, name, &contents, true); err != nil {
+		t.Fatal(err)
+	}
+	if contents.String() != "hello" {
+		t.Fatalf("expected hello got %q", contents.String())
+	}
+	contents.Reset()
+	if err := c.PutBucketRangeInWriter(ctx, name, &contents, 1, 3); err != nil {
+		t.Fatal(err)
+	}
+	if contents.String() != "ell" {
+		t.Fatalf("expected ell got %q", contents.String())
+	}
+	r, info, err := c.Download(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(downloaded) != "hello" || info.Size != 5 {
+		t.Fatalf("expected hello got %q size %d", downloaded, info.Size)
+	}
+
+	buckets, err := c.ListBuckets(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 1 || buckets[0].Name != name {
+		t.Fatalf("expected only %s listed got %#v", name, buckets)
+	}
+
+	if err := c.DeleteBucket(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Stat(name); err != storage.ErrNotFound {
+		t.Fatalf("expected the bucket to be gone from the backend got %v", err)
+	}
+	if _, err := c.StatBucket(ctx, name); !errors.Is(err, client.ErrBucketNotFound) {
+		t.Fatalf("expected bucket not found got %v", err)
+	}
+}
+
+func TestUploadLargerThanBucketKeepsContents(t *testing.T) {
+	backend := storage.NewMemoryBackend()
+	_, addr := startTestServer(t, testConfiguration(), backend)
+	c := connectTestClient(t, client.ClientConfiguration{ServerAddrAndPort: addr})
+	ctx := context.Background()
+
+	name, err := c.CreateBucket(ctx, "", 5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PutReaderInBucket(ctx, name, strings.NewReader("hello"), ""); err != nil {
+		t.Fatal(err)
+	}
+	err = c.PutReaderInBucket(ctx, name, strings.NewReader("hello world"), "")
+	if !errors.Is(err, client.ErrBucketTooSmall) {
+		t.Fatalf("expected bucket too small got %v", err)
+	}
+
+	r, metadata, err := backend.OpenReader(name, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "hello" || metadata.ContentLength != 5 {
+		t.Fatalf("failed upload changed the bucket to %q length %d", contents, metadata.ContentLength)
+	}
+}
+
+func TestMissingBucket(t *testing.T) {
+	_, addr := startTestServer(t, testConfiguration(), storage.NewMemoryBackend())
+	c := connectTestClient(t, client.ClientConfiguration{ServerAddrAndPort: addr})
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{"stat", func() error {
+			_, err := c.StatBucket(ctx, "missing")
+			return err
+		}},
+		{"get", func() error {
+			return c.PutBucketInWriter(ctx, "missing", ioutil.Discard, false)
+		}},
+		{"put", func() error {
+			return c.PutReaderInBucket(ctx, "missing", strings.NewReader("hello"), "")
+		}},
+		{"delete", func() error {
+			return c.DeleteBucket(ctx, "missing")
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.call(); !errors.Is(err, client.ErrBucketNotFound) {
+				t.Fatalf("expected bucket not found got %v", err)
+			}
+		})
+	}
+}
+
+// failingWriterBackend a memory backend that cannot open buckets for writing
+type failingWriterBackend struct {
+	*storage.MemoryBackend
+}
+
+func (b failingWriterBackend) OpenWriter(name string) (storage.Writer, error) {
+	return nil, errors.New("disk on fire")
+}
+
+func TestOpenWriterFailureKeepsConnection(t *testing.T) {
+	backend := failingWriterBackend{storage.NewMemoryBackend()}
+	_, addr := startTestServer(t, testConfiguration(), backend)
+	c := connectTestClient(t, client.ClientConfiguration{ServerAddrAndPort: addr})
+	ctx := context.Background()
+
+	name, err := c.CreateBucket(ctx, "", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.PutReaderInBucket(ctx, name, strings.NewReader("hello"), "")
+	if !errors.Is(err, client.ErrIOFailure) {
+		t.Fatalf("expected an io failure got %v", err)
+	}
+	// the upload was refused before the client sent its contents
+	if _, err := c.StatBucket(ctx, name); err != nil {
+		t.Fatalf("connection unusable after a refused upload. error: %v", err)
+	}
+}
+
+// unseekableReader hides the Seek of the reader it wraps
+type unseekableReader struct {
+	io.Reader
+}
+
+func TestUploadOfReaderThatCannotSeek(t *testing.T) {
+	hash, err := util.NewChecksumHash(util.DefaultChecksumAlgorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash.Write([]byte("hello"))
+	expectedChecksum := util.FormatChecksum(util.DefaultChecksumAlgorithm, hash)
+
+	tests := []struct {
+		name   string
+		reader func(t *testing.T, contents string) io.Reader
+	}{
+		{"reader", func(t *testing.T, contents string) io.Reader {
+			return unseekableReader{strings.NewReader(contents)}
+		}},
+		{"pipe", func(t *testing.T, contents string) io.Reader {
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { r.Close() })
+			go func() {
+				w.WriteString(contents)
+				w.Close()
+			}()
+			return r
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := storage.NewMemoryBackend()
+			_, addr := startTestServer(t, testConfiguration(), backend)
+			c := connectTestClient(t, client.ClientConfiguration{ServerAddrAndPort: addr})
+			ctx := context.Background()
+			name, err := c.CreateBucket(ctx, "", 10, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// only size bytes are sent of a longer reader
+			if err := c.Upload(ctx, name, test.reader(t, "hello world"), 5); err != nil {
+				t.Fatal(err)
+			}
+			contents, metadata := readTestBucket(t, backend, name)
+			if contents != "hello" || metadata.Checksum != expectedChecksum {
+				t.Fatalf("expected hello with checksum %s got %q %s", expectedChecksum, contents, metadata.Checksum)
+			}
+
+			// a reader that ends early leaves the bucket as it was
+			if err := c.Upload(ctx, name, test.reader(t, "bye"), 5); err == nil {
+				t.Fatal("expected an upload shorter than its size to fail")
+			}
+			if contents, _ := readTestBucket(t, backend, name); contents != "hello" {
+				t.Fatalf("short upload changed the bucket to %q", contents)
+			}
+		})
+	}
+}
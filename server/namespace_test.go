@@ -0,0 +1,77 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/genesis32/loft/storage"
+	"github.com/genesis32/loft/util"
+)
+
+// namespaceTestServer a server handling requests itself, without a listener,
+// on top of backend
+func namespaceTestServer(backend storage.Backend) *Server {
+	s := NewServer(testConfiguration()).(*Server)
+	s.backend = backend
+	return s
+}
+
+// expectErrorCode fails unless err is a request error with errorCode
+func expectErrorCode(t *testing.T, err error, errorCode int32) {
+	t.Helper()
+	requestErr, ok := err.(*requestError)
+	if !ok || requestErr.errorCode != errorCode {
+		t.Fatalf("expected %s got %v", util.ErrorCodeText(errorCode), err)
+	}
+}
+
+func TestNamespaceOwnershipOutlivesItsBuckets(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend func(t *testing.T) storage.Backend
+	}{
+		{"memory", func(t *testing.T) storage.Backend { return storage.NewMemoryBackend() }},
+		{"filesystem", func(t *testing.T) storage.Backend { return newTestFilesystemBackend(t) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := test.backend(t)
+			s := namespaceTestServer(backend)
+			if _, err := s.createNamedBucket("team/a", storage.Metadata{Owner: "alice"}, "alice"); err != nil {
+				t.Fatal(err)
+			}
+			if err := backend.Delete("team/a"); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := s.createNamedBucket("team/b", storage.Metadata{Owner: "bob"}, "bob")
+			expectErrorCode(t, err, util.ErrorCodeForbidden)
+			if _, err := s.createNamedBucket("team/b", storage.Metadata{Owner: "alice"}, "alice"); err != nil {
+				t.Fatalf("owner locked out of an empty namespace. error: %v", err)
+			}
+		})
+	}
+}
+
+func TestUnclaimedNamespaceChecksEveryBucket(t *testing.T) {
+	// buckets created before namespace owners were recorded
+	backend := storage.NewMemoryBackend()
+	for name, owner := range map[string]string{"old/a": "", "old/b": "alice"} {
+		if err := backend.Create(name, storage.Metadata{Owner: owner}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := namespaceTestServer(backend)
+
+	_, err := s.createNamedBucket("old/c", storage.Metadata{Owner: "bob"}, "bob")
+	expectErrorCode(t, err, util.ErrorCodeForbidden)
+	if _, err := s.createNamedBucket("old/c", storage.Metadata{Owner: "alice"}, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	owner, claimed, err := backend.NamespaceOwner("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claimed || owner != "alice" {
+		t.Fatalf("expected alice to have claimed the namespace got %q claimed:%v", owner, claimed)
+	}
+}
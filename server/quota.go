@@ -0,0 +1,125 @@
+package server
+
+import (
+	"github.com/genesis32/loft/storage"
+	"github.com/genesis32/loft/util"
+)
+
+// ownerQuota the quota of owner, 0 for no limit
+func (s *Server) ownerQuota(owner string) int64 {
+	if quota, ok := s.config.OwnerQuotas[owner]; ok {
+		return quota
+	}
+	return s.config.OwnerQuota
+}
+
+// quotasEnabled whether any quota is configured, so bucket capacities need
+// counting
+func (s *Server) quotasEnabled() bool {
+	return s.config.Quota > 0 || s.config.OwnerQuota > 0 || len(s.config.OwnerQuotas) > 0
+}
+
+// quotaUsage the capacity of every bucket in total and by owner. It is
+// counted from the backend the first time a quota is checked and kept up to
+// date as buckets are created and deleted.
+type quotaUsage struct {
+	used      int64
+	ownerUsed map[string]int64
+}
+
+// loadQuotaUsage counts the capacity of every bucket unless it has been
+// counted already. The caller holds quotaMu.
+func (s *Server) loadQuotaUsage() error {
+	if s.quotaUsage != nil {
+		return nil
+	}
+	uniqueIdentifiers, err := s.backend.List()
+	if err != nil {
+		return newRequestError(util.ErrorCodeIOFailure, err, "error listing buckets")
+	}
+	usage := &quotaUsage{ownerUsed: map[string]int64{}}
+	for _, uniqueIdentifier := range uniqueIdentifiers {
+		metadata, err := s.backend.Stat(uniqueIdentifier)
+		if err == storage.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return newRequestError(util.ErrorCodeIOFailure, err, "error reading bucket %s", uniqueIdentifier)
+		}
+		usage.used += metadata.Capacity
+		usage.ownerUsed[metadata.Owner] += metadata.Capacity
+	}
+	s.quotaUsage = usage
+	return nil
+}
+
+// addQuotaUsage counts a new bucket of numBytes owned by owner, or gives the
+// bytes back when numBytes is negative. The caller holds quotaMu.
+func (s *Server) addQuotaUsage(owner string, numBytes int64) {
+	if s.quotaUsage == nil {
+		return
+	}
+	s.quotaUsage.used += numBytes
+	s.quotaUsage.ownerUsed[owner] += numBytes
+}
+
+// deleteBucket deletes a bucket and gives its capacity back to the quotas
+func (s *Server) deleteBucket(uniqueIdentifier string, metadata storage.Metadata) error {
+	if !s.quotasEnabled() {
+		return s.backend.Delete(uniqueIdentifier)
+	}
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+	if err := s.backend.Delete(uniqueIdentifier); err != nil {
+		return err
+	}
+	s.addQuotaUsage(metadata.Owner, -metadata.Capacity)
+	return nil
+}
+
+// checkQuota fails unless a bucket of numBytes fits in the server quota and
+// the quota of owner. Buckets count against quotas with their capacity, not
+// with what has been uploaded to them, and expired buckets count until they
+// are deleted. The caller holds quotaMu.
+func (s *Server) checkQuota(owner string, numBytes int64) error {
+	ownerQuota := s.ownerQuota(owner)
+	if s.config.Quota == 0 && ownerQuota == 0 {
+		return nil
+	}
+	if err := s.loadQuotaUsage(); err != nil {
+		return err
+	}
+
+	used, ownerUsed := s.quotaUsage.used, s.quotaUsage.ownerUsed[owner]
+	if s.config.Quota > 0 && used+numBytes > s.config.Quota {
+		return newRequestError(util.ErrorCodeQuotaExceeded, nil,
+			"a %d byte bucket does not fit in the server quota of %d bytes with %d bytes in use", numBytes, s.config.Quota, used)
+	}
+	if ownerQuota > 0 && ownerUsed+numBytes > ownerQuota {
+		return newRequestError(util.ErrorCodeQuotaExceeded, nil,
+			"a %d byte bucket does not fit in the quota of %d bytes for '%s' with %d bytes in use", numBytes, ownerQuota, owner, ownerUsed)
+	}
+	return nil
+}
+
+// checkFreeSpace fails unless numBytes can be written while leaving the
+// configured free space on the disk. Backends that cannot tell how much space
+// is left are not checked.
+func (s *Server) checkFreeSpace(numBytes int64) error {
+	spaceReporter, ok := s.backend.(storage.SpaceReporter)
+	if !ok {
+		return nil
+	}
+	free, ok, err := spaceReporter.FreeSpace()
+	if err != nil {
+		return newRequestError(util.ErrorCodeIOFailure, err, "error checking free disk space")
+	}
+	if !ok {
+		return nil
+	}
+	if free-numBytes < s.config.MinFreeSpace {
+		return newRequestError(util.ErrorCodeQuotaExceeded, nil,
+			"not enough disk space: %d bytes free, %d bytes needed and %d bytes kept free", free, numBytes, s.config.MinFreeSpace)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/genesis32/loft/client"
+	"github.com/genesis32/loft/storage"
+	"github.com/genesis32/loft/util"
+	"github.com/pkg/errors"
+)
+
+// generateAs creates a bucket of numBytes on behalf of owner
+func generateAs(s *Server, owner string, numBytes int64) (string, error) {
+	clientConn := &ServerConnection{version: util.MaxProtocolVersion, owner: owner}
+	response, err := s.bucketGenerate2(clientConn, util.BucketGenerateRequest{NumBytesInBucket: numBytes})
+	return response.UniqueIdentifier, err
+}
+
+func TestServerQuota(t *testing.T) {
+	backend := storage.NewMemoryBackend()
+	// buckets from before the server started count too
+	if err := backend.Create("old", storage.Metadata{Capacity: 10}); err != nil {
+		t.Fatal(err)
+	}
+	config := testConfiguration()
+	config.Quota = 35
+	s, addr := startTestServer(t, config, backend)
+	ctx := context.Background()
+	c := connectTestClient(t, client.ClientConfiguration{ServerAddrAndPort: addr})
+
+	name, err := c.CreateBucket(ctx, "", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiring, err := c.CreateBucket(ctx, "", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CreateBucket(ctx, "", 10, 0); !errors.Is(err, client.ErrQuotaExceeded) {
+		t.Fatalf("expected the bucket over the quota to be refused got %v", err)
+	}
+	if _, err := c.CreateBucket(ctx, "", 5, 0); err != nil {
+		t.Fatalf("expected the bucket filling the quota to be created. error: %v", err)
+	}
+
+	// deleted and swept buckets give their capacity back
+	if err := c.DeleteBucket(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CreateBucket(ctx, "", 10, 0); err != nil {
+		t.Fatalf("expected a bucket in the room left by a deleted one. error: %v", err)
+	}
+	s.sweepExpiredBuckets(time.Now().Add(time.Minute + config.ExpiryGracePeriod))
+	if _, err := backend.Stat(expiring); err != storage.ErrNotFound {
+		t.Fatalf("expected the expired bucket to be swept got %v", err)
+	}
+	if _, err := c.CreateBucket(ctx, "", 10, 0); err != nil {
+		t.Fatalf("expected a bucket in the room left by a swept one. error: %v", err)
+	}
+	if _, err := c.CreateBucket(ctx, "", 1, 0); !errors.Is(err, client.ErrQuotaExceeded) {
+		t.Fatalf("expected the full quota to refuse a bucket got %v", err)
+	}
+}
+
+func TestOwnerQuotas(t *testing.T) {
+	config := testConfiguration()
+	config.OwnerQuota = 10
+	config.OwnerQuotas = map[string]int64{"CN=ci": 30, "CN=unlimited": 0}
+	s := NewServer(config).(*Server)
+	s.backend = storage.NewMemoryBackend()
+
+	tests := []struct {
+		owner string
+		fits  int64
+	}{
+		{"CN=alice", 10},
+		{"CN=bob", 10},
+		{"CN=ci", 30},
+	}
+	for _, test := range tests {
+		if _, err := generateAs(s, test.owner, test.fits); err != nil {
+			t.Fatalf("expected %s to fill their quota. error: %v", test.owner, err)
+		}
+		_, err := generateAs(s, test.owner, 1)
+		expectErrorCode(t, err, util.ErrorCodeQuotaExceeded)
+	}
+	if _, err := generateAs(s, "CN=unlimited", 1000); err != nil {
+		t.Fatalf("expected an owner with no quota to be unlimited. error: %v", err)
+	}
+
+	// a bucket given back makes room for its owner only
+	name, err := generateAs(s, "CN=dave", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConn := &ServerConnection{version: util.MaxProtocolVersion, owner: "CN=dave"}
+	if _, err := s.bucketDelete2(clientConn, util.BucketDeleteRequest{UniqueIdentifier: name}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = generateAs(s, "CN=alice", 1)
+	expectErrorCode(t, err, util.ErrorCodeQuotaExceeded)
+	if _, err := generateAs(s, "CN=dave", 10); err != nil {
+		t.Fatalf("expected the deleted bucket to be given back. error: %v", err)
+	}
+}
+
+// spaceReportingBackend a memory backend on a disk with free bytes left
+type spaceReportingBackend struct {
+	*storage.MemoryBackend
+	free int64
+	ok   bool
+}
+
+func (b *spaceReportingBackend) FreeSpace() (int64, bool, error) {
+	return b.free, b.ok, nil
+}
+
+func TestMinFreeSpace(t *testing.T) {
+	backend := &spaceReportingBackend{MemoryBackend: storage.NewMemoryBackend(), free: 150, ok: true}
+	config := testConfiguration()
+	config.MinFreeSpace = 100
+	_, addr := startTestServer(t, config, backend)
+	ctx := context.Background()
+	c := connectTestClient(t, client.ClientConfiguration{ServerAddrAndPort: addr})
+
+	name, err := c.CreateBucket(ctx, "", 50, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CreateBucket(ctx, "", 51, 0); !errors.Is(err, client.ErrQuotaExceeded) {
+		t.Fatalf("expected the bucket cutting into the free space to be refused got %v", err)
+	}
+
+	backend.free = 120
+	if err := c.Upload(ctx, name, strings.NewReader("hello"), 5); err != nil {
+		t.Fatalf("expected an upload that fits to succeed. error: %v", err)
+	}
+	upload := strings.Repeat("x", 30)
+	if err := c.Upload(ctx, name, strings.NewReader(upload), int64(len(upload))); !errors.Is(err, client.ErrQuotaExceeded) {
+		t.Fatalf("expected the upload cutting into the free space to be refused got %v", err)
+	}
+
+	// a disk whose free space cannot be told is not checked
+	backend.ok = false
+	if _, err := c.CreateBucket(ctx, "", 1000, 0); err != nil {
+		t.Fatalf("expected the unchecked disk to take the bucket. error: %v", err)
+	}
+}
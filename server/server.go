@@ -2,274 +2,1012 @@ package server
 
 import (
 	"bufio"
-	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
-	"math/rand"
 	"net"
 	"os"
-	"path"
+	"runtime/debug"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/genesis32/loft/storage"
 	"github.com/genesis32/loft/util"
 	"github.com/pkg/errors"
 )
 
 type ServerConfiguration struct {
-	ListenAddrAndPort     string
-	SslClientCertFilePath string
-	SslClientKeyFilePath  string
-	BucketPath            string
-	Verbose               bool
+	ListenAddrAndPort     string `yaml:"listen"`
+	SslClientCertFilePath string `yaml:"cert"`
+	SslClientKeyFilePath  string `yaml:"key"`
+	SslClientCAFilePath   string `yaml:"client_ca"`
+	StorageBackend        string `yaml:"storage_backend"`
+	BucketPath            string `yaml:"bucket_path"`
+	MaxBucketSize         int64  `yaml:"max_bucket_size"`
+	LogFilePath           string `yaml:"log_file"`
+	Verbose               bool   `yaml:"verbose"`
+	// UploadSessionIdleTimeout how long an upload session is kept without
+	// hearing from the client
+	UploadSessionIdleTimeout time.Duration `yaml:"upload_session_idle_timeout"`
+	// MaxUploadSessionsPerOwner how many upload sessions one owner may have
+	// open at once, 0 for no limit. Each holds an open writer until it is
+	// committed or expires.
+	MaxUploadSessionsPerOwner int `yaml:"max_upload_sessions_per_owner"`
+	// IdleTimeout how long a connection is kept open waiting for a request
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// HeaderReadTimeout how long a client has to complete the tls handshake
+	// or send the rest of a request once it starts
+	HeaderReadTimeout time.Duration `yaml:"header_read_timeout"`
+	// TransferTimeout how long a request, including the bytes of an upload or
+	// download, may go without any bytes moving
+	TransferTimeout time.Duration `yaml:"transfer_timeout"`
+	// BucketNameLength how many characters generated bucket names have
+	BucketNameLength int `yaml:"bucket_name_length"`
+	// ExpirySweepInterval how often expired buckets are looked for
+	ExpirySweepInterval time.Duration `yaml:"expiry_sweep_interval"`
+	// ExpiryGracePeriod how long an expired bucket is kept, failing requests
+	// as expired, before it is deleted
+	ExpiryGracePeriod time.Duration `yaml:"expiry_grace_period"`
+	// Quota the most bytes all buckets together may be created to hold, 0 for
+	// no limit
+	Quota int64 `yaml:"quota"`
+	// OwnerQuota the most bytes the buckets of any one owner may hold, 0 for
+	// no limit. Clients without a certificate share a single quota.
+	OwnerQuota int64 `yaml:"owner_quota"`
+	// OwnerQuotas replaces OwnerQuota for the owners listed by certificate subject
+	OwnerQuotas map[string]int64 `yaml:"owner_quotas"`
+	// MinFreeSpace the bytes of disk that creating a bucket or uploading to
+	// one must leave free
+	MinFreeSpace int64 `yaml:"min_free_space"`
 }
 
 type ServerConnection struct {
 	bufferedReader *bufio.Reader
 	bufferedWriter *bufio.Writer
 	theConn        net.Conn
+	deadlines      *deadlineConn
+	owner          string
+	version        int32
+	features       uint32
 }
 
 type Server struct {
 	config         ServerConfiguration
+	backend        storage.Backend
 	bufferedReader *bufio.Reader
 	bufferedWriter *bufio.Writer
 	theListener    net.Listener
+	sessionsMu     sync.Mutex
+	sessions       map[string]*uploadSession
+	// ownerSessions how many upload sessions each owner has open
+	ownerSessions map[string]int
+	// namespacesMu keeps two owners from claiming a namespace at once
+	namespacesMu sync.Mutex
+	// expiryMu keeps the sweeper from deleting a bucket that is being extended
+	expiryMu sync.Mutex
+	// quotaMu keeps concurrent creates from sharing the last of a quota or
+	// of the free space, and guards quotaUsage
+	quotaMu    sync.Mutex
+	quotaUsage *quotaUsage
 }
 
 type LoftServer interface {
 	StartAndServe()
-	bucketGenerate2(request util.BucketGenerateRequest) (util.BucketGenerateResponse, error)
-	bucketGetBytes2(w *bufio.Writer, request util.BucketGetBytesRequest) error
-	bucketPutBytes2(r io.Reader, w *bufio.Writer, request util.BucketPutBytesRequest) error
+	bucketGenerate2(clientConn *ServerConnection, request util.BucketGenerateRequest) (util.BucketGenerateResponse, error)
+	bucketGetBytes2(clientConn *ServerConnection, request util.BucketGetBytesRequest) error
+	bucketPutBytes2(clientConn *ServerConnection, request util.BucketPutBytesRequest) error
+	bucketDelete2(clientConn *ServerConnection, request util.BucketDeleteRequest) (util.BucketDeleteResponse, error)
+	bucketList2(clientConn *ServerConnection, request util.BucketListRequest) (util.BucketListResponse, error)
+	bucketStat2(clientConn *ServerConnection, request util.BucketStatRequest) (util.BucketStatResponse, error)
+	uploadSessionOpen2(clientConn *ServerConnection, request util.UploadSessionOpenRequest) (util.UploadSessionOpenResponse, error)
+	uploadSessionChunk2(clientConn *ServerConnection, request util.UploadSessionChunkRequest) (util.UploadSessionChunkResponse, error)
+	uploadSessionStatus2(clientConn *ServerConnection, request util.UploadSessionStatusRequest) (util.UploadSessionStatusResponse, error)
+	uploadSessionCommit2(clientConn *ServerConnection, request util.UploadSessionCommitRequest) (util.UploadSessionCommitResponse, error)
+	bucketExtend2(clientConn *ServerConnection, request util.BucketExtendRequest) (util.BucketExtendResponse, error)
 }
 
-func newServerConnection(conn net.Conn) *ServerConnection {
-	newConnection := &ServerConnection{theConn: conn}
-	newConnection.bufferedReader = bufio.NewReader(newConnection.theConn)
-	newConnection.bufferedWriter = bufio.NewWriter(newConnection.theConn)
+func newServerConnection(conn net.Conn, config ServerConfiguration) *ServerConnection {
+	// clients that never say hello speak the original protocol
+	newConnection := &ServerConnection{theConn: conn, version: util.ProtocolVersion1}
+	newConnection.deadlines = &deadlineConn{Conn: conn, writeTimeout: config.TransferTimeout}
+	newConnection.bufferedReader = bufio.NewReader(newConnection.deadlines)
+	newConnection.bufferedWriter = bufio.NewWriter(newConnection.deadlines)
 	return newConnection
 }
 
 func NewServer(config ServerConfiguration) LoftServer {
-	newServer := &Server{config: config}
+	newServer := &Server{config: config, sessions: map[string]*uploadSession{}, ownerSessions: map[string]int{}}
 	return newServer
 }
 
+// authenticate completes the tls handshake, if any, and records the subject of
+// the client certificate as the owner of the connection.
+func (c *ServerConnection) authenticate() error {
+	tlsConn, ok := c.theConn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return errors.Wrap(err, "tls handshake failed")
+	}
+	peerCertificates := tlsConn.ConnectionState().PeerCertificates
+	if len(peerCertificates) > 0 {
+		c.owner = peerCertificates[0].Subject.String()
+	}
+	return nil
+}
+
+func (c *ServerConnection) header(messageType int32) util.Header {
+	return util.Header{MessageType: messageType, Version: c.version}
+}
+
+// hello negotiates the protocol version and features used for the rest of the
+// connection
+func (c *ServerConnection) hello(request util.Hello) (util.HelloAck, error) {
+	helloAck := util.HelloAck{
+		Header:    util.Header{MessageType: util.HelloAckMessageType, Version: util.ProtocolVersion1},
+		ErrorCode: util.ErrorCodeNone,
+	}
+	version, ok := util.NegotiateProtocolVersion(request.MinVersion, request.MaxVersion)
+	if !ok {
+		helloAck.ErrorCode = util.ErrorCodeUnsupportedVersion
+		return helloAck, errors.Errorf("no common protocol version client min:%d max:%d server min:%d max:%d",
+			request.MinVersion, request.MaxVersion, util.MinProtocolVersion, util.MaxProtocolVersion)
+	}
+	c.version = version
+	c.features = request.Features & util.SupportedFeatures
+	helloAck.SelectedVersion = c.version
+	helloAck.Features = c.features
+	return helloAck, nil
+}
+
+// requestError a failed request that is reported to the client in an
+// ErrorResponse. The connection stays usable afterwards.
+type requestError struct {
+	errorCode int32
+	message   string
+	cause     error
+}
+
+func newRequestError(errorCode int32, cause error, format string, args ...interface{}) error {
+	return &requestError{errorCode: errorCode, message: fmt.Sprintf(format, args...), cause: cause}
+}
+
+func (e *requestError) Error() string {
+	if e.cause == nil {
+		return e.message
+	}
+	return e.message + ": " + e.cause.Error()
+}
+
+// writeError reports a failure to the client in an ErrorResponse
+func (c *ServerConnection) writeError(errorCode int32, message string) error {
+	errorResponse := util.ErrorResponse{
+		Header:    c.header(util.ErrorResponseMessageType),
+		ErrorCode: errorCode,
+		Message:   message,
+	}
+	err := util.WriteMessageToWriter(c.bufferedWriter, errorResponse)
+	if err != nil {
+		log.Printf("failed to write error response to %s. error: %v", c.theConn.RemoteAddr(), err)
+	}
+	return err
+}
+
+func isMalformedFrame(err error) bool {
+	switch errors.Cause(err) {
+	case util.ErrBadFrameMagic, util.ErrFrameTooLarge, util.ErrFrameChecksum:
+		return true
+	}
+	return false
+}
+
 func handleServerRequest2(server *Server, clientConn *ServerConnection) {
+	defer clientConn.theConn.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic serving %s: %v\n%s", clientConn.theConn.RemoteAddr(), r, debug.Stack())
+		}
+	}()
+
+	clientConn.theConn.SetDeadline(time.Now().Add(server.config.HeaderReadTimeout))
+	if err := clientConn.authenticate(); err != nil {
+		log.Printf("failed to authenticate %s. error: %v", clientConn.theConn.RemoteAddr(), err)
+		return
+	}
+	log.Printf("connection from %s owner: '%s'", clientConn.theConn.RemoteAddr(), clientConn.owner)
+
 	for {
 		var err error
 		log.Print("waiting for message")
-		size, err := clientConn.bufferedReader.ReadByte()
+		if err := clientConn.awaitRequest(server.config); err != nil {
+			if isTimeout(err) {
+				log.Printf("closing idle connection to %s", clientConn.theConn.RemoteAddr())
+			} else if err != io.EOF {
+				log.Printf("failed to read from %s. error: %v", clientConn.theConn.RemoteAddr(), err)
+			}
+			return
+		}
+		frameType, payload, err := util.ReadFrame(clientConn.bufferedReader, util.MaxFrameSize)
 		if err != nil {
 			if err == io.EOF {
 				break
-			} else {
-				log.Print(err)
-				return
 			}
+			log.Printf("failed to read frame from %s. error: %v", clientConn.theConn.RemoteAddr(), err)
+			if isMalformedFrame(err) {
+				clientConn.writeError(util.ErrorCodeMalformedMessage, err.Error())
+			}
+			return
 		}
 
-		messageBytes := make([]byte, 256)
-		_, err = io.ReadFull(clientConn.bufferedReader, messageBytes[:size])
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		messageBuffer := bytes.NewBuffer(messageBytes)
-		theMessage, err := util.DeserializeMessage2(messageBuffer)
+		theMessage, err := util.DecodeMessageFrame(frameType, payload)
 		if err != nil {
-			log.Fatal(err)
+			log.Printf("malformed message from %s. error: %v", clientConn.theConn.RemoteAddr(), err)
+			clientConn.writeError(util.ErrorCodeMalformedMessage, err.Error())
+			return
 		}
 
+		clientConn.startTransfer(server.config)
 		switch v := theMessage.(type) {
+		case util.Hello:
+			log.Printf("Hello: %+v", theMessage)
+			helloAck, err := clientConn.hello(v)
+			util.WriteMessageToWriter(clientConn.bufferedWriter, helloAck)
+			if err != nil {
+				log.Printf("closing connection to %s. error: %v", clientConn.theConn.RemoteAddr(), err)
+				return
+			}
+			log.Printf("negotiated protocol version: %d features: %d", clientConn.version, clientConn.features)
 		case util.BucketGenerateRequest:
 			log.Printf("BucketGenerateRequest: %+v", theMessage)
-			bucketGenerateResponse, err := server.bucketGenerate2(v)
-			if err != nil {
-				log.Fatal(err)
+			var bucketGenerateResponse util.BucketGenerateResponse
+			bucketGenerateResponse, err = server.bucketGenerate2(clientConn, v)
+			if err == nil {
+				log.Printf("generated bucket: %s", bucketGenerateResponse.UniqueIdentifier)
+				err = util.WriteMessageToWriter(clientConn.bufferedWriter, bucketGenerateResponse)
 			}
-			log.Printf(string(bucketGenerateResponse.UniqueIdentifier[:]))
-			util.WriteMessageToWriter(clientConn.bufferedWriter, bucketGenerateResponse)
 		case util.BucketPutBytesRequest:
 			log.Printf("BucketPutBytesRequest: %+v", theMessage)
-			err := server.bucketPutBytes2(clientConn.bufferedReader, clientConn.bufferedWriter, v)
-			if err != nil {
-				log.Fatal(err)
-			}
+			err = server.bucketPutBytes2(clientConn, v)
 		case util.BucketGetBytesRequest:
 			log.Printf("BucketGetBytesRequest: %+v", theMessage)
-			err := server.bucketGetBytes2(clientConn.bufferedWriter, v)
-			if err != nil {
-				log.Fatal(err)
+			err = server.bucketGetBytes2(clientConn, v)
+		case util.BucketDeleteRequest:
+			log.Printf("BucketDeleteRequest: %+v", theMessage)
+			var bucketDeleteResponse util.BucketDeleteResponse
+			bucketDeleteResponse, err = server.bucketDelete2(clientConn, v)
+			if err == nil {
+				err = util.WriteMessageToWriter(clientConn.bufferedWriter, bucketDeleteResponse)
+			}
+		case util.BucketListRequest:
+			log.Printf("BucketListRequest: %+v", theMessage)
+			var bucketListResponse util.BucketListResponse
+			bucketListResponse, err = server.bucketList2(clientConn, v)
+			if err == nil {
+				err = util.WriteMessageToWriter(clientConn.bufferedWriter, bucketListResponse)
+			}
+		case util.BucketStatRequest:
+			log.Printf("BucketStatRequest: %+v", theMessage)
+			var bucketStatResponse util.BucketStatResponse
+			bucketStatResponse, err = server.bucketStat2(clientConn, v)
+			if err == nil {
+				err = util.WriteMessageToWriter(clientConn.bufferedWriter, bucketStatResponse)
+			}
+		case util.UploadSessionOpenRequest:
+			log.Printf("UploadSessionOpenRequest: %+v", theMessage)
+			var uploadSessionOpenResponse util.UploadSessionOpenResponse
+			uploadSessionOpenResponse, err = server.uploadSessionOpen2(clientConn, v)
+			if err == nil {
+				err = util.WriteMessageToWriter(clientConn.bufferedWriter, uploadSessionOpenResponse)
 			}
+		case util.UploadSessionChunkRequest:
+			log.Printf("UploadSessionChunkRequest: session:%s offset:%d bytes:%d", v.SessionID, v.Offset, len(v.Data))
+			var uploadSessionChunkResponse util.UploadSessionChunkResponse
+			uploadSessionChunkResponse, err = server.uploadSessionChunk2(clientConn, v)
+			if err == nil {
+				err = util.WriteMessageToWriter(clientConn.bufferedWriter, uploadSessionChunkResponse)
+			}
+		case util.UploadSessionStatusRequest:
+			log.Printf("UploadSessionStatusRequest: %+v", theMessage)
+			var uploadSessionStatusResponse util.UploadSessionStatusResponse
+			uploadSessionStatusResponse, err = server.uploadSessionStatus2(clientConn, v)
+			if err == nil {
+				err = util.WriteMessageToWriter(clientConn.bufferedWriter, uploadSessionStatusResponse)
+			}
+		case util.UploadSessionCommitRequest:
+			log.Printf("UploadSessionCommitRequest: %+v", theMessage)
+			var uploadSessionCommitResponse util.UploadSessionCommitResponse
+			uploadSessionCommitResponse, err = server.uploadSessionCommit2(clientConn, v)
+			if err == nil {
+				err = util.WriteMessageToWriter(clientConn.bufferedWriter, uploadSessionCommitResponse)
+			}
+		case util.BucketExtendRequest:
+			log.Printf("BucketExtendRequest: %+v", theMessage)
+			var bucketExtendResponse util.BucketExtendResponse
+			bucketExtendResponse, err = server.bucketExtend2(clientConn, v)
+			if err == nil {
+				err = util.WriteMessageToWriter(clientConn.bufferedWriter, bucketExtendResponse)
+			}
+		default:
+			err = newRequestError(util.ErrorCodeMalformedMessage, nil, "unexpected message %T", v)
+		}
+
+		if requestErr, ok := err.(*requestError); ok {
+			log.Printf("request from %s failed. error: %v", clientConn.theConn.RemoteAddr(), requestErr)
+			err = clientConn.writeError(requestErr.errorCode, requestErr.message)
+		}
+		if err != nil {
+			// the connection is in an unknown state, e.g. part way through a transfer
+			log.Printf("closing connection to %s. error: %+v", clientConn.theConn.RemoteAddr(), err)
+			return
 		}
 		clientConn.bufferedWriter.Flush()
 	}
 }
 
-const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+// generateBucketNameAttempts how many random names are tried before creating a
+// bucket gives up. A second attempt should already be vanishingly rare.
+const generateBucketNameAttempts = 5
+
+// generateBucketName picks the names tried for new buckets, tests replace it
+// to force collisions
+var generateBucketName = util.GenerateBucketName
+
+// parseBucketName checks the bucket name in a request before it gets
+// anywhere near storage
+func parseBucketName(s string) (util.BucketName, error) {
+	bucketName, err := util.ParseBucketName(s)
+	if err != nil {
+		return bucketName, newRequestError(util.ErrorCodeInvalidBucketName, nil, "%v", err)
+	}
+	return bucketName, nil
+}
+
+func bucketInfo(uniqueIdentifier string, metadata storage.Metadata) util.BucketInfo {
+	return util.BucketInfo{
+		UniqueIdentifier: uniqueIdentifier,
+		Capacity:         metadata.Capacity,
+		Size:             metadata.ContentLength,
+		CreatedAt:        metadata.CreatedAt.UnixNano(),
+		ModifiedAt:       metadata.UpdatedAt.UnixNano(),
+		ExpiresAt:        expiresAtUnixNano(metadata.ExpiresAt),
+	}
+}
+
+// checkBucketOwner fails unless owner may access the bucket. Buckets created
+// without a client certificate have no owner and are accessible to everyone.
+func checkBucketOwner(uniqueIdentifier string, metadata storage.Metadata, owner string) error {
+	if metadata.Owner != "" && metadata.Owner != owner {
+		return newRequestError(util.ErrorCodeForbidden, nil, "'%s' does not own bucket %s", owner, uniqueIdentifier)
+	}
+	return nil
+}
 
-func generateBucketName() [util.BucketNameLength]byte {
-	rand.Seed(time.Now().UnixNano())
-	var b [util.BucketNameLength]byte
-	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
+// statBucket returns the metadata for a bucket that exists, has not expired
+// and is owned by owner
+func (s *Server) statBucket(uniqueIdentifier string, owner string) (storage.Metadata, error) {
+	metadata, err := s.statBucketIncludingExpired(uniqueIdentifier, owner)
+	if err != nil {
+		return metadata, err
 	}
-	return b
+	if bucketExpired(metadata, time.Now()) {
+		return metadata, newRequestError(util.ErrorCodeBucketExpired, nil,
+			"bucket %s expired at %s", uniqueIdentifier, metadata.ExpiresAt.Format(time.RFC3339))
+	}
+	return metadata, nil
 }
 
-func bucketNameToString(bucketName [util.BucketNameLength]byte) string {
-	return string(bucketName[:])
+// statBucketIncludingExpired is statBucket for requests that may still be
+// made of a bucket waiting out its grace period
+func (s *Server) statBucketIncludingExpired(uniqueIdentifier string, owner string) (storage.Metadata, error) {
+	metadata, err := s.backend.Stat(uniqueIdentifier)
+	if err == storage.ErrNotFound {
+		return metadata, newRequestError(util.ErrorCodeBucketNotFound, nil, "bucket %s does not exist", uniqueIdentifier)
+	}
+	if err != nil {
+		return metadata, newRequestError(util.ErrorCodeIOFailure, err, "error reading bucket %s", uniqueIdentifier)
+	}
+	if err := checkBucketOwner(uniqueIdentifier, metadata, owner); err != nil {
+		return metadata, err
+	}
+	return metadata, nil
+}
+
+// tlsConfig returns the tls configuration for the listener or nil when the
+// server should serve plaintext.
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	keyFilePath := strings.TrimSpace(s.config.SslClientKeyFilePath)
+	certFilePath := strings.TrimSpace(s.config.SslClientCertFilePath)
+	if keyFilePath == "" && certFilePath == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFilePath, keyFilePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load key pair cert:%s key:%s", certFilePath, keyFilePath)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	caFilePath := strings.TrimSpace(s.config.SslClientCAFilePath)
+	if caFilePath != "" {
+		caCert, err := ioutil.ReadFile(caFilePath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read client ca:%s", caFilePath)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caCert) {
+			return nil, errors.Errorf("failed to parse client ca:%s", caFilePath)
+		}
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
 }
 
 func (s *Server) StartAndServe() {
 	var err error
 
-	if stat, err := os.Stat(s.config.BucketPath); err != nil || !stat.IsDir() {
+	if err := s.config.Validate(); err != nil {
+		log.Fatalf("invalid configuration. error: %v", err)
+	}
+
+	if s.config.LogFilePath != "" {
+		logFile, err := os.OpenFile(s.config.LogFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatalf("failed to open log file. error: %v", err)
+		}
+		defer logFile.Close()
+		log.SetOutput(logFile)
+	}
+
+	if s.backend == nil {
+		s.backend, err = newBackend(s.config)
 		if err != nil {
-			log.Fatalf("failed to stat bucket path. error: %+v", errors.Wrapf(err, "invalid bucket path"))
+			log.Fatalf("failed to open storage. error: %v", err)
 		}
-		log.Fatalf("bucket path: %s is not a directory", s.config.BucketPath)
 	}
 
-	log.Printf("using bucket path: %s", s.config.BucketPath)
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		log.Fatalf("failed to configure tls. error: %v", err)
+	}
+
 	s.theListener, err = net.Listen("tcp", s.config.ListenAddrAndPort)
 	if err != nil {
 		log.Fatalf("failed to start listener. error: %+v", errors.Wrapf(err, "failed to start listener on %s", s.config.ListenAddrAndPort))
 	}
+	if tlsConfig != nil {
+		log.Printf("serving tls with cert: %s", s.config.SslClientCertFilePath)
+		s.theListener = tls.NewListener(s.theListener, tlsConfig)
+	}
 	defer s.theListener.Close()
 
+	go s.expireUploadSessionsForever()
+	go s.sweepExpiredBucketsForever()
+
 	log.Printf("Listening for connection on %s", s.config.ListenAddrAndPort)
+	if err := s.serve(s.theListener); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serve handles each connection accepted from listener on its own goroutine
+// until the listener fails
+func (s *Server) serve(listener net.Listener) error {
+	var acceptDelay time.Duration
 	for {
-		conn, err := s.theListener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
-			log.Fatal(err)
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if acceptDelay == 0 {
+					acceptDelay = 5 * time.Millisecond
+				} else {
+					acceptDelay *= 2
+				}
+				if maxDelay := 1 * time.Second; acceptDelay > maxDelay {
+					acceptDelay = maxDelay
+				}
+				log.Printf("failed to accept connection. retrying in %v. error: %v", acceptDelay, err)
+				time.Sleep(acceptDelay)
+				continue
+			}
+			return errors.Wrap(err, "failed to accept connection")
 		}
-		// TODO: Set read timeout
-		clientConnection := newServerConnection(conn)
+		acceptDelay = 0
+		clientConnection := newServerConnection(conn, s.config)
 		go handleServerRequest2(s, clientConnection)
 	}
 }
 
-func (s *Server) bucketGenerate2(request util.BucketGenerateRequest) (util.BucketGenerateResponse, error) {
-	bucketName := generateBucketName()
-	bucketPath := path.Join(s.config.BucketPath, bucketNameToString(bucketName))
+func (s *Server) bucketGenerate2(clientConn *ServerConnection, request util.BucketGenerateRequest) (util.BucketGenerateResponse, error) {
+	if request.NumBytesInBucket < 0 {
+		return util.BucketGenerateResponse{}, newRequestError(util.ErrorCodeMalformedMessage, nil,
+			"bucket size must not be negative got:%d", request.NumBytesInBucket)
+	}
+	if request.TimeToLive < 0 {
+		return util.BucketGenerateResponse{}, newRequestError(util.ErrorCodeMalformedMessage, nil,
+			"time to live must not be negative got:%v", time.Duration(request.TimeToLive))
+	}
+	if s.config.MaxBucketSize > 0 && request.NumBytesInBucket > s.config.MaxBucketSize {
+		return util.BucketGenerateResponse{}, newRequestError(util.ErrorCodeBucketTooLarge, nil,
+			"%d bytes exceeds the maximum bucket size of %d bytes", request.NumBytesInBucket, s.config.MaxBucketSize)
+	}
+
 	bucketGenerateResponse := util.BucketGenerateResponse{
-		Header:                   util.Header{MessageType: util.BucketGenerateResponseMessageType, Version: 1},
-		UniqueIdentifier:         bucketName,
-		UniqueIdentifierNumBytes: util.BucketNameLength,
-		ErrorCode:                0,
+		Header:    clientConn.header(util.BucketGenerateResponseMessageType),
+		ErrorCode: util.ErrorCodeNone,
 	}
-	f, err := os.Create(bucketPath)
-	if err != nil {
-		bucketGenerateResponse.ErrorCode = 1
+	now := time.Now()
+	metadata := storage.Metadata{
+		Capacity:  request.NumBytesInBucket,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Owner:     clientConn.owner,
+		ExpiresAt: expiresAt(now, request.TimeToLive),
+	}
+	if s.quotasEnabled() || s.config.MinFreeSpace > 0 {
+		s.quotaMu.Lock()
+		defer s.quotaMu.Unlock()
+	}
+	if err := s.checkQuota(clientConn.owner, request.NumBytesInBucket); err != nil {
+		return bucketGenerateResponse, err
+	}
+	if err := s.checkFreeSpace(request.NumBytesInBucket); err != nil {
 		return bucketGenerateResponse, err
 	}
 
-	if err := f.Truncate(request.NumBytesInBucket); err != nil {
-		bucketGenerateResponse.ErrorCode = 2
+	if request.Name != "" {
+		bucketName, err := s.createNamedBucket(request.Name, metadata, clientConn.owner)
+		bucketGenerateResponse.UniqueIdentifier = bucketName.String()
+		if err == nil {
+			s.addQuotaUsage(clientConn.owner, request.NumBytesInBucket)
+		}
 		return bucketGenerateResponse, err
 	}
-	return bucketGenerateResponse, nil
+
+	// clients on protocol version 1 can only carry names of a fixed length
+	nameLength := s.config.BucketNameLength
+	if clientConn.version < util.ProtocolVersion2 {
+		nameLength = util.BucketNameLengthV1
+	}
+	// Create fails rather than replace a bucket that already has the name
+	for attempt := 0; attempt < generateBucketNameAttempts; attempt++ {
+		bucketName, err := generateBucketName(nameLength)
+		if err != nil {
+			return bucketGenerateResponse, newRequestError(util.ErrorCodeInternal, err, "error naming bucket")
+		}
+		err = s.backend.Create(bucketName.String(), metadata)
+		if errors.Cause(err) == storage.ErrExists {
+			log.Printf("generated bucket name %s is taken", bucketName)
+			continue
+		}
+		if err != nil {
+			return bucketGenerateResponse, newRequestError(util.ErrorCodeIOFailure, err, "error creating bucket")
+		}
+		s.addQuotaUsage(clientConn.owner, request.NumBytesInBucket)
+		bucketGenerateResponse.UniqueIdentifier = bucketName.String()
+		return bucketGenerateResponse, nil
+	}
+	return bucketGenerateResponse, newRequestError(util.ErrorCodeInternal, nil,
+		"no free bucket name after %d attempts", generateBucketNameAttempts)
+}
+
+// createNamedBucket creates a bucket under the name the client asked for.
+// The first owner to create a bucket in a namespace keeps it to themselves,
+// even once every bucket in it is gone.
+func (s *Server) createNamedBucket(name string, metadata storage.Metadata, owner string) (util.BucketName, error) {
+	bucketName, err := parseBucketName(name)
+	if err != nil {
+		return bucketName, err
+	}
+
+	s.namespacesMu.Lock()
+	defer s.namespacesMu.Unlock()
+	claimed, err := s.checkNamespaceOwner(bucketName, owner)
+	if err != nil {
+		return bucketName, err
+	}
+	err = s.backend.Create(bucketName.String(), metadata)
+	if errors.Cause(err) == storage.ErrExists {
+		return bucketName, newRequestError(util.ErrorCodeBucketExists, err, "bucket %s already exists", bucketName)
+	}
+	if err != nil {
+		return bucketName, newRequestError(util.ErrorCodeIOFailure, err, "error creating bucket %s", bucketName)
+	}
+	if namespace := bucketName.Namespace(); namespace != "" && !claimed {
+		if err := s.backend.ClaimNamespace(namespace, owner); err != nil {
+			s.backend.Delete(bucketName.String())
+			return bucketName, newRequestError(util.ErrorCodeIOFailure, err, "error claiming namespace %s", namespace)
+		}
+	}
+	return bucketName, nil
+}
+
+// checkNamespaceOwner fails unless owner may create buckets in the namespace
+// of bucketName and reports whether the namespace is already claimed
+func (s *Server) checkNamespaceOwner(bucketName util.BucketName, owner string) (bool, error) {
+	namespace := bucketName.Namespace()
+	if namespace == "" {
+		return false, nil
+	}
+	namespaceOwner, claimed, err := s.backend.NamespaceOwner(namespace)
+	if err != nil {
+		return false, newRequestError(util.ErrorCodeIOFailure, err, "error reading owner of namespace %s", namespace)
+	}
+	if claimed {
+		if namespaceOwner != "" && namespaceOwner != owner {
+			return true, newRequestError(util.ErrorCodeForbidden, nil, "'%s' may not create buckets in namespace %s", owner, namespace)
+		}
+		return true, nil
+	}
+	return false, s.checkUnclaimedNamespace(namespace, owner)
 }
 
-func (s *Server) bucketGetBytes2(w *bufio.Writer, request util.BucketGetBytesRequest) error {
-	uniqueIdentifier := string(request.UniqueIdentifier[:])
+// checkUnclaimedNamespace fails unless every bucket in a namespace from before
+// owners were recorded belongs to owner or to nobody
+func (s *Server) checkUnclaimedNamespace(namespace string, owner string) error {
+	names, err := s.backend.List()
+	if err != nil {
+		return newRequestError(util.ErrorCodeIOFailure, err, "error listing buckets")
+	}
+	prefix := namespace + util.BucketNamespaceSeparator
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		metadata, err := s.backend.Stat(name)
+		if err == storage.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return newRequestError(util.ErrorCodeIOFailure, err, "error reading bucket %s", name)
+		}
+		if metadata.Owner != "" && metadata.Owner != owner {
+			return newRequestError(util.ErrorCodeForbidden, nil, "'%s' may not create buckets in namespace %s", owner, namespace)
+		}
+	}
+	return nil
+}
+
+func (s *Server) bucketGetBytes2(clientConn *ServerConnection, request util.BucketGetBytesRequest) error {
+	w := clientConn.bufferedWriter
+	bucketName, err := parseBucketName(request.UniqueIdentifier)
+	uniqueIdentifier := bucketName.String()
 	bucketGetBytesResponse := util.BucketGetBytesResponse{
-		Header:    util.Header{MessageType: util.BucketGetBytesResponseMessageType, Version: 1},
-		ErrorCode: 0,
+		Header:    clientConn.header(util.BucketGetBytesResponseMessageType),
+		ErrorCode: util.ErrorCodeNone,
 		Size:      -1,
 	}
+	if err != nil {
+		return err
+	}
+
+	metadata, err := s.statBucket(uniqueIdentifier, clientConn.owner)
+	if err != nil {
+		return err
+	}
 
-	bucketPath := path.Join(s.config.BucketPath, uniqueIdentifier)
-	fileInfo, err := os.Stat(bucketPath)
+	// a negative offset counts back from the end, stopping at the start
+	offset := request.Offset
+	if offset < 0 {
+		offset += metadata.ContentLength
+		if offset < 0 {
+			offset = 0
+		}
+	}
+
+	bucketReader, metadata, err := s.backend.OpenReader(uniqueIdentifier, offset, -1)
+	if err == storage.ErrNotFound {
+		return newRequestError(util.ErrorCodeBucketNotFound, nil, "bucket %s does not exist", uniqueIdentifier)
+	}
 	if err != nil {
-		log.Printf("cannot find bucket '%s' err: %+v", bucketPath, err)
-		bucketGetBytesResponse.ErrorCode = 1
-		util.WriteMessageToWriter(w, bucketGetBytesResponse)
-		return errors.Wrapf(err, "error reading bucket")
+		return newRequestError(util.ErrorCodeIOFailure, err, "error opening bucket %s", uniqueIdentifier)
 	}
+	defer bucketReader.Close()
 
-	bucketGetBytesResponse.Size = fileInfo.Size()
+	// the bucket may have been replaced since it was checked so the range is
+	// taken from the metadata of the contents being read
+	if offset > metadata.ContentLength {
+		return newRequestError(util.ErrorCodeInvalidRange, nil,
+			"offset %d is past the end of bucket %s of %d bytes", offset, uniqueIdentifier, metadata.ContentLength)
+	}
+	length := metadata.ContentLength - offset
+	if request.Length >= 0 && request.Length < length {
+		length = request.Length
+	}
 
-	util.WriteMessageToWriter(w, bucketGetBytesResponse)
+	bucketGetBytesResponse.Size = length
+	bucketGetBytesResponse.Checksum = metadata.Checksum
+	bucketGetBytesResponse.Offset = offset
+	bucketGetBytesResponse.ContentLength = metadata.ContentLength
+
+	if err := util.WriteMessageToWriter(w, bucketGetBytesResponse); err != nil {
+		return err
+	}
 	log.Printf("Writing size: %d bytes", bucketGetBytesResponse.Size)
 
-	fp, _ := os.Open(bucketPath)
-	defer fp.Close()
+	bytesWrote, err := io.CopyN(w, bucketReader, length)
+	if err != nil {
+		return errors.Wrapf(err, "error writing bucket %s to client. wrote %d bytes", uniqueIdentifier, bytesWrote)
+	}
+	log.Printf("Wrote %d bytes", bytesWrote)
+
+	return nil
+}
 
+// receiveBytes copies numBytes of an upload from r to dst
+func receiveBytes(r *bufio.Reader, dst io.Writer, numBytes int64) error {
 	buff := make([]byte, 32*1024)
-	for true {
-		var err error
-		bytesRead, err := fp.Read(buff)
-		if bytesRead == 0 && err == io.EOF {
-			break
+	for numBytes > int64(0) {
+		if int64(len(buff)) > numBytes {
+			buff = buff[:numBytes]
+		}
+		bytesRead, err := r.Read(buff)
+		if err != nil {
+			if err == io.EOF {
+				return errors.Errorf("client closed upload with %d bytes left", numBytes)
+			}
+			return err
 		}
-		bytesWrote, err := w.Write(buff[:bytesRead])
+		nb, err := dst.Write(buff[:bytesRead])
+		log.Printf("wrote %d bytes to file", nb)
 		if err != nil {
-			log.Fatal(err)
+			return newRequestError(util.ErrorCodeIOFailure, err, "error writing bucket")
 		}
-		log.Printf("Wrote %d bytes", bytesWrote)
+		numBytes -= int64(bytesRead)
+		log.Printf("number of bytes left to read: %d", numBytes)
 	}
-
 	return nil
 }
 
-func (s *Server) bucketPutBytes2(r io.Reader, w *bufio.Writer, request util.BucketPutBytesRequest) error {
-	uniqueIdentifier := string(request.UniqueIdentifier[:])
+// receiveChunks copies an upload of unknown length from r to dst, failing
+// once it grows past capacity, and returns its length
+func receiveChunks(r *bufio.Reader, dst io.Writer, capacity int64) (int64, error) {
+	var contentLength int64
+	for {
+		chunkLength, err := util.ReadChunkLength(r)
+		if errors.Cause(err) == util.ErrChunkTooLarge {
+			return contentLength, newRequestError(util.ErrorCodeMalformedMessage, err, "invalid chunk")
+		}
+		if err != nil {
+			return contentLength, err
+		}
+		if chunkLength == 0 {
+			return contentLength, nil
+		}
+		if contentLength+chunkLength > capacity {
+			return contentLength, newRequestError(util.ErrorCodeBucketTooSmall, nil, "upload is larger than the %d bytes the bucket holds", capacity)
+		}
+		if err := receiveBytes(r, dst, chunkLength); err != nil {
+			return contentLength, err
+		}
+		contentLength += chunkLength
+	}
+}
+
+func (s *Server) bucketPutBytes2(clientConn *ServerConnection, request util.BucketPutBytesRequest) error {
+	r, w := clientConn.bufferedReader, clientConn.bufferedWriter
+	bucketName, err := parseBucketName(request.UniqueIdentifier)
+	uniqueIdentifier := bucketName.String()
 	bucketPutBytesResponse := util.BucketPutBytesResponse{
-		Header:    util.Header{MessageType: util.BucketPutBytesResponseMessageType, Version: 1},
-		ErrorCode: 0,
+		Header:    clientConn.header(util.BucketPutBytesResponseMessageType),
+		ErrorCode: util.ErrorCodeNone,
+	}
+	if err != nil {
+		return err
 	}
 
-	bucketPath := path.Join(s.config.BucketPath, uniqueIdentifier)
-	fileInfo, err := os.Stat(bucketPath)
-	if os.IsNotExist(err) {
-		log.Printf("bucket %s does not exist: %+v", uniqueIdentifier, err)
-		bucketPutBytesResponse.ErrorCode = 1
-		util.WriteMessageToWriter(w, bucketPutBytesResponse)
-		return nil
+	metadata, err := s.statBucket(uniqueIdentifier, clientConn.owner)
+	if err != nil {
+		return err
 	}
 
-	if request.NumBytes > fileInfo.Size() {
-		log.Printf("request file size %d too big for bucket: %s size %d", request.NumBytes, uniqueIdentifier, fileInfo.Size())
-		bucketPutBytesResponse.ErrorCode = 2
-		util.WriteMessageToWriter(w, bucketPutBytesResponse)
-		return nil
+	chunked := request.NumBytes == util.ChunkedUploadLength
+	if request.NumBytes < 0 && !chunked {
+		return newRequestError(util.ErrorCodeMalformedMessage, nil, "upload size must not be negative got:%d", request.NumBytes)
+	}
+	if request.NumBytes > metadata.Capacity {
+		return newRequestError(util.ErrorCodeBucketTooSmall, nil, "%d bytes too big for bucket %s of %d bytes", request.NumBytes, uniqueIdentifier, metadata.Capacity)
+	}
+	// the length of a chunked upload is not known so only the space that
+	// must be kept free is checked
+	neededBytes := request.NumBytes
+	if chunked {
+		neededBytes = 0
+	}
+	if err := s.checkFreeSpace(neededBytes); err != nil {
+		return err
+	}
+	checksumAlgorithm := util.DefaultChecksumAlgorithm
+	if request.Checksum != "" {
+		checksumAlgorithm, err = util.ChecksumAlgorithm(request.Checksum)
+		if err != nil {
+			return newRequestError(util.ErrorCodeMalformedMessage, err, "invalid checksum for bucket %s", uniqueIdentifier)
+		}
+	}
+	hash, err := util.NewChecksumHash(checksumAlgorithm)
+	if err != nil {
+		return err
 	}
 
-	// TODO: Always send back a message saying whether or not we accept before we read the file
-	numBytesToRead := request.NumBytes
-	log.Printf("bucketName:%s bucketSize: %d", uniqueIdentifier, numBytesToRead)
-	util.WriteMessageToWriter(w, bucketPutBytesResponse)
+	// opened before accepting the upload so a failure is reported while the
+	// connection is still in step with the client
+	bucketWriter, err := s.backend.OpenWriter(uniqueIdentifier)
+	if err == storage.ErrNotFound {
+		return newRequestError(util.ErrorCodeBucketNotFound, nil, "bucket %s does not exist", uniqueIdentifier)
+	}
+	if err != nil {
+		return newRequestError(util.ErrorCodeIOFailure, err, "error opening bucket %s", uniqueIdentifier)
+	}
 
-	// TODO: SHould we add anything in after the bytes have been received
+	log.Printf("bucketName:%s bucketSize: %d", uniqueIdentifier, request.NumBytes)
+	if err := util.WriteMessageToWriter(w, bucketPutBytesResponse); err != nil {
+		bucketWriter.Abort()
+		return err
+	}
 
-	f, err := os.Create(bucketPath)
+	// the bucket keeps its previous contents until the upload is committed
+	contentLength := request.NumBytes
+	if chunked {
+		contentLength, err = receiveChunks(r, io.MultiWriter(bucketWriter, hash), metadata.Capacity)
+	} else {
+		err = receiveBytes(r, io.MultiWriter(bucketWriter, hash), request.NumBytes)
+	}
 	if err != nil {
-		log.Fatal(err)
+		bucketWriter.Abort()
+		// the rest of the upload is still on its way so the connection has to
+		// be closed after telling the client why
+		if requestErr, ok := err.(*requestError); ok {
+			clientConn.writeError(requestErr.errorCode, requestErr.message)
+		}
+		return errors.Wrapf(err, "error receiving bucket %s", uniqueIdentifier)
 	}
-	buff := make([]byte, 32*1024)
-	for numBytesToRead > int64(0) {
-		bytesRead, err := r.Read(buff)
+
+	// every byte has been read so a failure from here on can be reported
+	// without closing the connection, if the client waits for a reply
+	failUpload := func(err error) error {
+		if clientConn.features&util.FeatureCommitAck == 0 {
+			return errors.Wrap(err, "upload failed")
+		}
+		return err
+	}
+
+	expectedChecksum := request.Checksum
+	if chunked {
+		trailer, err := util.ReadMessageFromReader(r)
 		if err != nil {
-			f.Close()
-			if err == io.EOF {
-				return nil
+			bucketWriter.Abort()
+			return errors.Wrapf(err, "error reading trailer of bucket %s", uniqueIdentifier)
+		}
+		bucketPutBytesTrailer, ok := trailer.(util.BucketPutBytesTrailer)
+		if !ok {
+			bucketWriter.Abort()
+			return failUpload(newRequestError(util.ErrorCodeMalformedMessage, nil, "expected a trailer got %T", trailer))
+		}
+		expectedChecksum = bucketPutBytesTrailer.Checksum
+		if expectedChecksum != "" {
+			if algorithm, err := util.ChecksumAlgorithm(expectedChecksum); err != nil || algorithm != checksumAlgorithm {
+				bucketWriter.Abort()
+				return failUpload(newRequestError(util.ErrorCodeMalformedMessage, err, "trailer checksum must be %s", checksumAlgorithm))
 			}
-			os.Remove(bucketPath)
-			return err
 		}
-		nb, err := f.Write(buff[:bytesRead])
-		log.Printf("wrote %d bytes to file", nb)
+	}
+
+	checksum := util.FormatChecksum(checksumAlgorithm, hash)
+	if expectedChecksum != "" && expectedChecksum != checksum {
+		bucketWriter.Abort()
+		return failUpload(newRequestError(util.ErrorCodeChecksumMismatch, nil,
+			"upload to bucket %s has checksum %s expected %s", uniqueIdentifier, checksum, expectedChecksum))
+	}
+
+	metadata.ContentLength = contentLength
+	metadata.ContentType = request.ContentType
+	metadata.Checksum = checksum
+	metadata.UpdatedAt = time.Now()
+	if err := s.commitUpload(uniqueIdentifier, bucketWriter, metadata); err != nil {
+		return failUpload(newRequestError(util.ErrorCodeIOFailure, err, "error committing bucket %s", uniqueIdentifier))
+	}
+	log.Printf("committed %d bytes to bucket %s", contentLength, uniqueIdentifier)
+
+	if clientConn.features&util.FeatureCommitAck != 0 {
+		return util.WriteMessageToWriter(w, bucketPutBytesResponse)
+	}
+	return nil
+}
+
+func (s *Server) bucketDelete2(clientConn *ServerConnection, request util.BucketDeleteRequest) (util.BucketDeleteResponse, error) {
+	bucketName, err := parseBucketName(request.UniqueIdentifier)
+	uniqueIdentifier := bucketName.String()
+	bucketDeleteResponse := util.BucketDeleteResponse{
+		Header:    clientConn.header(util.BucketDeleteResponseMessageType),
+		ErrorCode: util.ErrorCodeNone,
+	}
+	if err != nil {
+		return bucketDeleteResponse, err
+	}
+
+	s.expiryMu.Lock()
+	defer s.expiryMu.Unlock()
+	// an expired bucket can be deleted without waiting for the sweeper
+	metadata, err := s.statBucketIncludingExpired(uniqueIdentifier, clientConn.owner)
+	if err != nil {
+		return bucketDeleteResponse, err
+	}
+
+	if err := s.deleteBucket(uniqueIdentifier, metadata); err != nil {
+		return bucketDeleteResponse, newRequestError(util.ErrorCodeIOFailure, err, "error removing bucket %s", uniqueIdentifier)
+	}
+	log.Printf("deleted bucket: %s", uniqueIdentifier)
+	return bucketDeleteResponse, nil
+}
+
+func (s *Server) bucketList2(clientConn *ServerConnection, request util.BucketListRequest) (util.BucketListResponse, error) {
+	bucketListResponse := util.BucketListResponse{
+		Header:    clientConn.header(util.BucketListResponseMessageType),
+		ErrorCode: util.ErrorCodeNone,
+	}
+
+	maxResults := int(request.MaxResults)
+	if maxResults <= 0 {
+		maxResults = util.DefaultBucketListPageSize
+	}
+	if maxResults > util.MaxBucketListPageSize {
+		maxResults = util.MaxBucketListPageSize
+	}
+
+	// the names are sorted which makes the last name on a page usable as the
+	// token for the next one
+	uniqueIdentifiers, err := s.backend.List()
+	if err != nil {
+		return bucketListResponse, newRequestError(util.ErrorCodeIOFailure, err, "error listing buckets")
+	}
+	now := time.Now()
+	for _, uniqueIdentifier := range uniqueIdentifiers {
+		if uniqueIdentifier <= request.PageToken {
+			continue
+		}
+		metadata, err := s.backend.Stat(uniqueIdentifier)
 		if err != nil {
-			f.Close()
-			os.Remove(bucketPath)
-			return err
+			log.Printf("skipping bucket %s in list. error: %v", uniqueIdentifier, err)
+			continue
+		}
+		if err := checkBucketOwner(uniqueIdentifier, metadata, clientConn.owner); err != nil {
+			continue
+		}
+		if bucketExpired(metadata, now) {
+			continue
+		}
+		if len(bucketListResponse.Buckets) == maxResults {
+			bucketListResponse.NextPageToken = bucketListResponse.Buckets[maxResults-1].UniqueIdentifier
+			break
 		}
-		numBytesToRead -= int64(bytesRead)
-		log.Printf("number of bytes left to read: %d", numBytesToRead)
+		bucketListResponse.Buckets = append(bucketListResponse.Buckets, bucketInfo(uniqueIdentifier, metadata))
 	}
+	return bucketListResponse, nil
+}
 
-	return nil
+func (s *Server) bucketStat2(clientConn *ServerConnection, request util.BucketStatRequest) (util.BucketStatResponse, error) {
+	bucketName, err := parseBucketName(request.UniqueIdentifier)
+	uniqueIdentifier := bucketName.String()
+	bucketStatResponse := util.BucketStatResponse{
+		Header:    clientConn.header(util.BucketStatResponseMessageType),
+		ErrorCode: util.ErrorCodeNone,
+	}
+	if err != nil {
+		return bucketStatResponse, err
+	}
+
+	metadata, err := s.statBucket(uniqueIdentifier, clientConn.owner)
+	if err != nil {
+		return bucketStatResponse, err
+	}
+	bucketStatResponse.Bucket = bucketInfo(uniqueIdentifier, metadata)
+	bucketStatResponse.Owner = metadata.Owner
+	bucketStatResponse.ContentType = metadata.ContentType
+	bucketStatResponse.Checksum = metadata.Checksum
+	return bucketStatResponse, nil
 }
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/genesis32/loft/client"
+	"github.com/genesis32/loft/storage"
+	"github.com/genesis32/loft/util"
+)
+
+// testConfiguration a valid configuration serving from memory with timeouts
+// long enough not to get in the way
+func testConfiguration() ServerConfiguration {
+	return ServerConfiguration{
+		ListenAddrAndPort:        "127.0.0.1:0",
+		StorageBackend:           StorageBackendMemory,
+		UploadSessionIdleTimeout: time.Hour,
+		IdleTimeout:              time.Minute,
+		HeaderReadTimeout:        10 * time.Second,
+		TransferTimeout:          10 * time.Second,
+		BucketNameLength:         util.DefaultBucketNameLength,
+		ExpirySweepInterval:      time.Minute,
+		ExpiryGracePeriod:        time.Hour,
+	}
+}
+
+// startTestServer serves backend on a loopback port until the test ends and
+// returns the address to dial
+func startTestServer(t *testing.T, config ServerConfiguration, backend storage.Backend) (*Server, string) {
+	t.Helper()
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(config).(*Server)
+	s.backend = backend
+
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", config.ListenAddrAndPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go s.serve(listener)
+	return s, listener.Addr().String()
+}
+
+// connectTestClient connects a client to the server at addr
+func connectTestClient(t *testing.T, config client.ClientConfiguration) client.LoftClient {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := client.NewClient(config)
+	if err := c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// sendGarbage writes garbage to the server at addr and returns everything the
+// server sends back before closing the connection
+func sendGarbage(t *testing.T, addr string, garbage []byte) []byte {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(garbage); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("server did not close the connection after garbage. error: %v", err)
+	}
+	return reply
+}
+
+func TestGarbageOnlyClosesItsConnection(t *testing.T) {
+	_, addr := startTestServer(t, testConfiguration(), storage.NewMemoryBackend())
+	ctx := context.Background()
+	// connected before the garbage arrives and used after it
+	bystander := connectTestClient(t, client.ClientConfiguration{ServerAddrAndPort: addr})
+
+	unknownMessage, err := util.SerializeMessage2(util.BucketDeleteResponse{
+		Header: util.Header{MessageType: 999, Version: util.ProtocolVersion1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unknownMessageFrame bytes.Buffer
+	if err := util.WriteFrame(&unknownMessageFrame, util.FrameTypeMessage, unknownMessage.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		garbage    []byte
+		errorReply bool
+	}{
+		{"not a frame", []byte("GET / HTTP/1.1\r\n\r\n"), false},
+		{"frame too large", []byte("LOFT\x01\xff\xff\xff\xff\x00\x00\x00\x00"), true},
+		{"bad checksum", []byte("LOFT\x01\x00\x00\x00\x01\x00\x00\x00\x00x"), true},
+		{"unknown message", unknownMessageFrame.Bytes(), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reply := sendGarbage(t, addr, test.garbage)
+			if !test.errorReply {
+				return
+			}
+			message, err := util.ReadMessageFromReader(bufio.NewReader(bytes.NewReader(reply)))
+			if err != nil {
+				t.Fatalf("expected an error response. error: %v", err)
+			}
+			if errorResponse, ok := message.(util.ErrorResponse); !ok || errorResponse.ErrorCode != util.ErrorCodeMalformedMessage {
+				t.Fatalf("expected a malformed message error got %#v", message)
+			}
+		})
+	}
+
+	if _, err := bystander.CreateBucket(ctx, "", 10, 0); err != nil {
+		t.Fatalf("connection open during the garbage stopped working. error: %v", err)
+	}
+	newcomer := connectTestClient(t, client.ClientConfiguration{ServerAddrAndPort: addr})
+	buckets, err := newcomer.ListBuckets(ctx)
+	if err != nil {
+		t.Fatalf("new connection after the garbage failed. error: %v", err)
+	}
+	if len(buckets) != 1 {
+		t.Fatalf("expected the bucket created after the garbage got %d buckets", len(buckets))
+	}
+}
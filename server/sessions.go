@@ -0,0 +1,307 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"hash"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/genesis32/loft/storage"
+	"github.com/genesis32/loft/util"
+	"github.com/pkg/errors"
+)
+
+// uploadSession an upload that outlives the connection that started it. The
+// bytes received so far are held by the storage writer until the session is
+// committed or expires. Sessions only live in memory so a restart loses them.
+type uploadSession struct {
+	mu                sync.Mutex
+	id                string
+	uniqueIdentifier  string
+	owner             string
+	numBytes          int64
+	offset            int64
+	contentType       string
+	checksum          string
+	checksumAlgorithm string
+	hash              hash.Hash
+	writer            storage.Writer
+	lastUsed          time.Time
+	closed            bool
+}
+
+func newUploadSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "failed to generate upload session id")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// lockUploadSession returns the session locked for the caller to unlock
+func (s *Server) lockUploadSession(sessionID string, owner string) (*uploadSession, error) {
+	s.sessionsMu.Lock()
+	session, ok := s.sessions[sessionID]
+	s.sessionsMu.Unlock()
+	if !ok {
+		return nil, newRequestError(util.ErrorCodeUploadSessionNotFound, nil, "upload session %s does not exist", sessionID)
+	}
+	if session.owner != owner {
+		return nil, newRequestError(util.ErrorCodeForbidden, nil, "'%s' does not own upload session %s", owner, sessionID)
+	}
+
+	session.mu.Lock()
+	if session.closed {
+		session.mu.Unlock()
+		return nil, newRequestError(util.ErrorCodeUploadSessionNotFound, nil, "upload session %s does not exist", sessionID)
+	}
+	session.lastUsed = time.Now()
+	return session, nil
+}
+
+// closeUploadSession discards the session, which must be locked, aborting
+// the upload unless it was committed
+func (s *Server) closeUploadSession(session *uploadSession, abort bool) {
+	session.closed = true
+	if abort {
+		if err := session.writer.Abort(); err != nil {
+			log.Printf("failed to abort upload session %s. error: %v", session.id, err)
+		}
+	}
+	s.sessionsMu.Lock()
+	delete(s.sessions, session.id)
+	s.sessionsMu.Unlock()
+	s.releaseUploadSession(session.owner)
+}
+
+// reserveUploadSession counts a session that owner is about to open, failing
+// if owner already has as many open as allowed
+func (s *Server) reserveUploadSession(owner string) error {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	open := s.ownerSessions[owner]
+	if limit := s.config.MaxUploadSessionsPerOwner; limit > 0 && open >= limit {
+		return newRequestError(util.ErrorCodeQuotaExceeded, nil,
+			"'%s' already has %d upload sessions open, commit or abandon one first", owner, open)
+	}
+	s.ownerSessions[owner] = open + 1
+	return nil
+}
+
+// releaseUploadSession stops counting a session of owner
+func (s *Server) releaseUploadSession(owner string) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	if s.ownerSessions[owner]--; s.ownerSessions[owner] <= 0 {
+		delete(s.ownerSessions, owner)
+	}
+}
+
+// expireUploadSessions closes every session that has been idle for longer
+// than the configured timeout
+func (s *Server) expireUploadSessions(now time.Time) {
+	var idle []*uploadSession
+	s.sessionsMu.Lock()
+	for _, session := range s.sessions {
+		idle = append(idle, session)
+	}
+	s.sessionsMu.Unlock()
+
+	for _, session := range idle {
+		session.mu.Lock()
+		if !session.closed && now.Sub(session.lastUsed) > s.config.UploadSessionIdleTimeout {
+			log.Printf("expiring upload session %s for bucket %s", session.id, session.uniqueIdentifier)
+			s.closeUploadSession(session, true)
+		}
+		session.mu.Unlock()
+	}
+}
+
+func (s *Server) expireUploadSessionsForever() {
+	interval := s.config.UploadSessionIdleTimeout / 4
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for now := range time.Tick(interval) {
+		s.expireUploadSessions(now)
+	}
+}
+
+func (s *Server) uploadSessionOpen2(clientConn *ServerConnection, request util.UploadSessionOpenRequest) (util.UploadSessionOpenResponse, error) {
+	bucketName, err := parseBucketName(request.UniqueIdentifier)
+	uniqueIdentifier := bucketName.String()
+	uploadSessionOpenResponse := util.UploadSessionOpenResponse{
+		Header:    clientConn.header(util.UploadSessionOpenResponseMessageType),
+		ErrorCode: util.ErrorCodeNone,
+	}
+	if err != nil {
+		return uploadSessionOpenResponse, err
+	}
+
+	metadata, err := s.statBucket(uniqueIdentifier, clientConn.owner)
+	if err != nil {
+		return uploadSessionOpenResponse, err
+	}
+	if request.NumBytes < 0 {
+		return uploadSessionOpenResponse, newRequestError(util.ErrorCodeMalformedMessage, nil, "upload size must not be negative got:%d", request.NumBytes)
+	}
+	if request.NumBytes > metadata.Capacity {
+		return uploadSessionOpenResponse, newRequestError(util.ErrorCodeBucketTooSmall, nil,
+			"%d bytes too big for bucket %s of %d bytes", request.NumBytes, uniqueIdentifier, metadata.Capacity)
+	}
+	if err := s.checkFreeSpace(request.NumBytes); err != nil {
+		return uploadSessionOpenResponse, err
+	}
+	checksumAlgorithm := util.DefaultChecksumAlgorithm
+	if request.Checksum != "" {
+		checksumAlgorithm, err = util.ChecksumAlgorithm(request.Checksum)
+		if err != nil {
+			return uploadSessionOpenResponse, newRequestError(util.ErrorCodeMalformedMessage, err, "invalid checksum for bucket %s", uniqueIdentifier)
+		}
+	}
+	hash, err := util.NewChecksumHash(checksumAlgorithm)
+	if err != nil {
+		return uploadSessionOpenResponse, err
+	}
+
+	sessionID, err := newUploadSessionID()
+	if err != nil {
+		return uploadSessionOpenResponse, newRequestError(util.ErrorCodeInternal, err, "error starting upload session")
+	}
+	if err := s.reserveUploadSession(clientConn.owner); err != nil {
+		return uploadSessionOpenResponse, err
+	}
+	writer, err := s.backend.OpenWriter(uniqueIdentifier)
+	if err != nil {
+		s.releaseUploadSession(clientConn.owner)
+		return uploadSessionOpenResponse, newRequestError(util.ErrorCodeIOFailure, err, "error opening bucket %s", uniqueIdentifier)
+	}
+
+	session := &uploadSession{
+		id:                sessionID,
+		uniqueIdentifier:  uniqueIdentifier,
+		owner:             clientConn.owner,
+		numBytes:          request.NumBytes,
+		contentType:       request.ContentType,
+		checksum:          request.Checksum,
+		checksumAlgorithm: checksumAlgorithm,
+		hash:              hash,
+		writer:            writer,
+		lastUsed:          time.Now(),
+	}
+	s.sessionsMu.Lock()
+	s.sessions[sessionID] = session
+	s.sessionsMu.Unlock()
+	log.Printf("opened upload session %s for %d bytes to bucket %s", sessionID, request.NumBytes, uniqueIdentifier)
+
+	uploadSessionOpenResponse.SessionID = sessionID
+	return uploadSessionOpenResponse, nil
+}
+
+func (s *Server) uploadSessionChunk2(clientConn *ServerConnection, request util.UploadSessionChunkRequest) (util.UploadSessionChunkResponse, error) {
+	uploadSessionChunkResponse := util.UploadSessionChunkResponse{
+		Header:    clientConn.header(util.UploadSessionChunkResponseMessageType),
+		ErrorCode: util.ErrorCodeNone,
+	}
+
+	session, err := s.lockUploadSession(request.SessionID, clientConn.owner)
+	if err != nil {
+		return uploadSessionChunkResponse, err
+	}
+	defer session.mu.Unlock()
+
+	if request.Offset < 0 || request.Offset > session.offset {
+		return uploadSessionChunkResponse, newRequestError(util.ErrorCodeMalformedMessage, nil,
+			"chunk at offset %d does not follow the %d bytes in upload session %s", request.Offset, session.offset, session.id)
+	}
+	// skip whatever was already received from a chunk that is sent again
+	data := request.Data
+	if skip := session.offset - request.Offset; skip < int64(len(data)) {
+		data = data[skip:]
+	} else {
+		data = nil
+	}
+	if session.offset+int64(len(data)) > session.numBytes {
+		return uploadSessionChunkResponse, newRequestError(util.ErrorCodeMalformedMessage, nil,
+			"chunk at offset %d runs past the %d bytes of upload session %s", request.Offset, session.numBytes, session.id)
+	}
+
+	if _, err := session.writer.Write(data); err != nil {
+		s.closeUploadSession(session, true)
+		return uploadSessionChunkResponse, newRequestError(util.ErrorCodeIOFailure, err, "error writing bucket %s", session.uniqueIdentifier)
+	}
+	session.hash.Write(data)
+	session.offset += int64(len(data))
+	log.Printf("upload session %s has %d of %d bytes", session.id, session.offset, session.numBytes)
+
+	uploadSessionChunkResponse.Offset = session.offset
+	return uploadSessionChunkResponse, nil
+}
+
+func (s *Server) uploadSessionStatus2(clientConn *ServerConnection, request util.UploadSessionStatusRequest) (util.UploadSessionStatusResponse, error) {
+	uploadSessionStatusResponse := util.UploadSessionStatusResponse{
+		Header:    clientConn.header(util.UploadSessionStatusResponseMessageType),
+		ErrorCode: util.ErrorCodeNone,
+	}
+
+	session, err := s.lockUploadSession(request.SessionID, clientConn.owner)
+	if err != nil {
+		return uploadSessionStatusResponse, err
+	}
+	defer session.mu.Unlock()
+
+	uploadSessionStatusResponse.Offset = session.offset
+	uploadSessionStatusResponse.NumBytes = session.numBytes
+	return uploadSessionStatusResponse, nil
+}
+
+func (s *Server) uploadSessionCommit2(clientConn *ServerConnection, request util.UploadSessionCommitRequest) (util.UploadSessionCommitResponse, error) {
+	uploadSessionCommitResponse := util.UploadSessionCommitResponse{
+		Header:    clientConn.header(util.UploadSessionCommitResponseMessageType),
+		ErrorCode: util.ErrorCodeNone,
+	}
+
+	session, err := s.lockUploadSession(request.SessionID, clientConn.owner)
+	if err != nil {
+		return uploadSessionCommitResponse, err
+	}
+	defer session.mu.Unlock()
+
+	if session.offset != session.numBytes {
+		return uploadSessionCommitResponse, newRequestError(util.ErrorCodeMalformedMessage, nil,
+			"upload session %s has %d of %d bytes", session.id, session.offset, session.numBytes)
+	}
+	checksum := util.FormatChecksum(session.checksumAlgorithm, session.hash)
+	if session.checksum != "" && session.checksum != checksum {
+		s.closeUploadSession(session, true)
+		return uploadSessionCommitResponse, newRequestError(util.ErrorCodeChecksumMismatch, nil,
+			"upload to bucket %s has checksum %s expected %s", session.uniqueIdentifier, checksum, session.checksum)
+	}
+
+	metadata, err := s.statBucket(session.uniqueIdentifier, session.owner)
+	if err != nil {
+		s.closeUploadSession(session, true)
+		return uploadSessionCommitResponse, err
+	}
+	metadata.ContentLength = session.numBytes
+	metadata.ContentType = session.contentType
+	metadata.Checksum = checksum
+	metadata.UpdatedAt = time.Now()
+	err = s.commitUpload(session.uniqueIdentifier, session.writer, metadata)
+	s.closeUploadSession(session, false)
+	if err == storage.ErrNotFound {
+		return uploadSessionCommitResponse, newRequestError(util.ErrorCodeBucketNotFound, nil, "bucket %s does not exist", session.uniqueIdentifier)
+	}
+	if err != nil {
+		return uploadSessionCommitResponse, newRequestError(util.ErrorCodeIOFailure, err, "error committing bucket %s", session.uniqueIdentifier)
+	}
+	log.Printf("committed upload session %s of %d bytes to bucket %s", session.id, session.numBytes, session.uniqueIdentifier)
+
+	uploadSessionCommitResponse.Checksum = checksum
+	return uploadSessionCommitResponse, nil
+}
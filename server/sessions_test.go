@@ -0,0 +1,255 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/genesis32/loft/client"
+	"github.com/genesis32/loft/storage"
+	"github.com/genesis32/loft/util"
+	"github.com/pkg/errors"
+)
+
+// writerCountingBackend a memory backend that counts the writers it opened
+// which are neither committed nor aborted
+type writerCountingBackend struct {
+	*storage.MemoryBackend
+	mu   sync.Mutex
+	open int
+}
+
+func newWriterCountingBackend() *writerCountingBackend {
+	return &writerCountingBackend{MemoryBackend: storage.NewMemoryBackend()}
+}
+
+func (b *writerCountingBackend) OpenWriter(name string) (storage.Writer, error) {
+	w, err := b.MemoryBackend.OpenWriter(name)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	b.open++
+	b.mu.Unlock()
+	return &countedWriter{Writer: w, backend: b}, nil
+}
+
+func (b *writerCountingBackend) openWriters() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+type countedWriter struct {
+	storage.Writer
+	backend *writerCountingBackend
+}
+
+func (w *countedWriter) Commit(metadata storage.Metadata) error {
+	defer w.closed()
+	return w.Writer.Commit(metadata)
+}
+
+func (w *countedWriter) Abort() error {
+	defer w.closed()
+	return w.Writer.Abort()
+}
+
+func (w *countedWriter) closed() {
+	w.backend.mu.Lock()
+	w.backend.open--
+	w.backend.mu.Unlock()
+}
+
+// sessionTestUpload creates a bucket and a file of contents to upload to it
+func sessionTestUpload(t *testing.T, c client.LoftClient, contents string) (string, string) {
+	t.Helper()
+	name, err := c.CreateBucket(context.Background(), "", 64, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filePath := filepath.Join(t.TempDir(), "upload.txt")
+	if err := ioutil.WriteFile(filePath, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name, filePath
+}
+
+// sendChunk sends a chunk of an upload session straight to the server the
+// way a client that is later interrupted does
+func sendChunk(t *testing.T, s *Server, sessionID string, offset int64, data string) int64 {
+	t.Helper()
+	clientConn := &ServerConnection{version: util.MaxProtocolVersion}
+	response, err := s.uploadSessionChunk2(clientConn, util.UploadSessionChunkRequest{SessionID: sessionID, Offset: offset, Data: []byte(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.Offset
+}
+
+func TestUploadSessionResumesWhereItStopped(t *testing.T) {
+	backend := newWriterCountingBackend()
+	s, addr := startTestServer(t, testConfiguration(), backend)
+	ctx := context.Background()
+	c := connectTestClient(t, client.ClientConfiguration{ServerAddrAndPort: addr})
+	name, filePath := sessionTestUpload(t, c, "hello world")
+
+	sessionID, err := c.StartUploadSession(ctx, name, filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset := sendChunk(t, s, sessionID, 0, "hello"); offset != 5 {
+		t.Fatalf("expected 5 bytes received got %d", offset)
+	}
+	// a chunk sent again after its reply was lost only adds what is new
+	if offset := sendChunk(t, s, sessionID, 3, "lo wo"); offset != 8 {
+		t.Fatalf("expected 8 bytes received got %d", offset)
+	}
+	clientConn := &ServerConnection{version: util.MaxProtocolVersion}
+	_, err = s.uploadSessionChunk2(clientConn, util.UploadSessionChunkRequest{SessionID: sessionID, Offset: 9, Data: []byte("ld")})
+	expectErrorCode(t, err, util.ErrorCodeMalformedMessage)
+	status, err := s.uploadSessionStatus2(clientConn, util.UploadSessionStatusRequest{SessionID: sessionID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Offset != 8 || status.NumBytes != 11 {
+		t.Fatalf("expected 8 of 11 bytes got %d of %d", status.Offset, status.NumBytes)
+	}
+
+	// the rest comes over a new connection
+	resumed := connectTestClient(t, client.ClientConfiguration{ServerAddrAndPort: addr})
+	if err := resumed.ResumeUploadSession(ctx, sessionID, filePath); err != nil {
+		t.Fatal(err)
+	}
+	contents, metadata := readTestBucket(t, backend, name)
+	if contents != "hello world" || metadata.ContentType == "" || metadata.Checksum == "" {
+		t.Fatalf("unexpected bucket after resuming %q %#v", contents, metadata)
+	}
+	if open := backend.openWriters(); open != 0 {
+		t.Fatalf("expected the committed session to leave no writers open got %d", open)
+	}
+	_, err = s.uploadSessionStatus2(clientConn, util.UploadSessionStatusRequest{SessionID: sessionID})
+	expectErrorCode(t, err, util.ErrorCodeUploadSessionNotFound)
+}
+
+// readTestBucket the contents and metadata of a bucket in backend
+func readTestBucket(t *testing.T, backend storage.Backend, name string) (string, storage.Metadata) {
+	t.Helper()
+	r, metadata, err := backend.OpenReader(name, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents), metadata
+}
+
+func TestIdleUploadSessionExpires(t *testing.T) {
+	backend := newWriterCountingBackend()
+	config := testConfiguration()
+	s, addr := startTestServer(t, config, backend)
+	ctx := context.Background()
+	c := connectTestClient(t, client.ClientConfiguration{ServerAddrAndPort: addr})
+	name, filePath := sessionTestUpload(t, c, "hello world")
+
+	sessionID, err := c.StartUploadSession(ctx, name, filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendChunk(t, s, sessionID, 0, "hello")
+
+	s.expireUploadSessions(time.Now())
+	if open := backend.openWriters(); open != 1 {
+		t.Fatalf("expected the session in use to keep its writer got %d open", open)
+	}
+	s.expireUploadSessions(time.Now().Add(config.UploadSessionIdleTimeout + time.Minute))
+	if open := backend.openWriters(); open != 0 {
+		t.Fatalf("expected the expired session to abort its writer got %d open", open)
+	}
+
+	err = c.ResumeUploadSession(ctx, sessionID, filePath)
+	if !errors.Is(err, client.ErrUploadSessionNotFound) {
+		t.Fatalf("expected the expired session to be gone got %v", err)
+	}
+	if contents, _ := readTestBucket(t, backend, name); contents != "" {
+		t.Fatalf("expected the bucket to be untouched got %q", contents)
+	}
+}
+
+func TestUploadSessionsLimitedPerOwner(t *testing.T) {
+	config := testConfiguration()
+	config.MaxUploadSessionsPerOwner = 2
+	backend := newWriterCountingBackend()
+	s, addr := startTestServer(t, config, backend)
+	ctx := context.Background()
+	c := connectTestClient(t, client.ClientConfiguration{ServerAddrAndPort: addr})
+	name, filePath := sessionTestUpload(t, c, "hello world")
+
+	var sessionIDs []string
+	for i := 0; i < config.MaxUploadSessionsPerOwner; i++ {
+		sessionID, err := c.StartUploadSession(ctx, name, filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	if _, err := c.StartUploadSession(ctx, name, filePath); !errors.Is(err, client.ErrQuotaExceeded) {
+		t.Fatalf("expected the session over the limit to be refused got %v", err)
+	}
+	if open := backend.openWriters(); open != config.MaxUploadSessionsPerOwner {
+		t.Fatalf("expected the refused session to open no writer got %d open", open)
+	}
+
+	// other owners have their own limit
+	other := &ServerConnection{version: util.MaxProtocolVersion, owner: "CN=other"}
+	if _, err := s.uploadSessionOpen2(other, util.UploadSessionOpenRequest{UniqueIdentifier: name, NumBytes: 1}); err != nil {
+		t.Fatalf("expected another owner to open a session. error: %v", err)
+	}
+
+	// finishing a session makes room for another
+	if err := c.ResumeUploadSession(ctx, sessionIDs[0], filePath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.StartUploadSession(ctx, name, filePath); err != nil {
+		t.Fatalf("expected a session once another was committed. error: %v", err)
+	}
+}
+
+func TestUploadSessionNotCommittedToRecreatedBucket(t *testing.T) {
+	backend := newTestFilesystemBackend(t)
+	_, addr := startTestServer(t, testConfiguration(), backend)
+	ctx := context.Background()
+	c := connectTestClient(t, client.ClientConfiguration{ServerAddrAndPort: addr})
+	name, err := c.CreateBucket(ctx, "team/report", 64, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filePath := filepath.Join(t.TempDir(), "upload.txt")
+	if err := ioutil.WriteFile(filePath, []byte("old report"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sessionID, err := c.StartUploadSession(ctx, name, filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.DeleteBucket(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CreateBucket(ctx, name, 32, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ResumeUploadSession(ctx, sessionID, filePath); !errors.Is(err, client.ErrBucketNotFound) {
+		t.Fatalf("expected the upload to the deleted bucket to be refused got %v", err)
+	}
+	contents, metadata := readTestBucket(t, backend, name)
+	if contents != "" || metadata.Capacity != 32 {
+		t.Fatalf("expected the new bucket to be untouched got %q %#v", contents, metadata)
+	}
+}
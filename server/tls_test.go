@@ -0,0 +1,258 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/genesis32/loft/client"
+	"github.com/genesis32/loft/storage"
+	"github.com/pkg/errors"
+)
+
+// writeSelfSignedCert writes a certificate for the loopback address, which
+// can also sign client certificates, along with its key
+func writeSelfSignedCert(t *testing.T, dir string, commonName string) (string, string) {
+	t.Helper()
+	return writeCert(t, dir, commonName, "", "")
+}
+
+// writeCert writes a certificate for commonName signed by the certificate and
+// key at signerCertFilePath and signerKeyFilePath, or by itself when they are
+// empty, along with its key
+func writeCert(t *testing.T, dir string, commonName string, signerCertFilePath string, signerKeyFilePath string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{"localhost"},
+	}
+	parent, parentKey := template, interface{}(key)
+	if signerCertFilePath != "" {
+		signer, err := tls.LoadX509KeyPair(signerCertFilePath, signerKeyFilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent, err = x509.ParseCertificate(signer.Certificate[0]); err != nil {
+			t.Fatal(err)
+		}
+		parentKey = signer.PrivateKey
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFilePath := filepath.Join(dir, commonName+".pem")
+	keyFilePath := filepath.Join(dir, commonName+".key")
+	if err := ioutil.WriteFile(certFilePath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFilePath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFilePath, keyFilePath
+}
+
+func TestTLSLoopback(t *testing.T) {
+	dir := t.TempDir()
+	certFilePath, keyFilePath := writeSelfSignedCert(t, dir, "server")
+	config := testConfiguration()
+	config.SslClientCertFilePath = certFilePath
+	config.SslClientKeyFilePath = keyFilePath
+	_, addr := startTestServer(t, config, storage.NewMemoryBackend())
+
+	c := connectTestClient(t, client.ClientConfiguration{ServerAddrAndPort: addr, SslClientCertFilePath: certFilePath})
+	ctx := context.Background()
+	bucketIdentifier, err := c.CreateBucket(ctx, "", 64, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := []byte("sent over tls")
+	if err := c.Upload(ctx, bucketIdentifier, bytes.NewReader(contents), int64(len(contents))); err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := c.Download(ctx, bucketIdentifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	downloaded, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded, contents) {
+		t.Fatalf("downloaded %q expected %q", downloaded, contents)
+	}
+}
+
+func TestTLSUntrustedServer(t *testing.T) {
+	dir := t.TempDir()
+	certFilePath, keyFilePath := writeSelfSignedCert(t, dir, "server")
+	otherCertFilePath, _ := writeSelfSignedCert(t, dir, "other")
+	config := testConfiguration()
+	config.SslClientCertFilePath = certFilePath
+	config.SslClientKeyFilePath = keyFilePath
+	_, addr := startTestServer(t, config, storage.NewMemoryBackend())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := client.NewClient(client.ClientConfiguration{ServerAddrAndPort: addr, SslClientCertFilePath: otherCertFilePath})
+	if err := c.Connect(ctx); err == nil {
+		t.Fatal("connected to a server whose certificate is not trusted")
+	}
+}
+
+// mutualTLSTestServer serves tls, requiring client certificates signed by the
+// returned ca, and returns the configuration a client without an identity
+// needs to trust it
+func mutualTLSTestServer(t *testing.T, dir string) (client.ClientConfiguration, string, string) {
+	t.Helper()
+	certFilePath, keyFilePath := writeSelfSignedCert(t, dir, "server")
+	caCertFilePath, caKeyFilePath := writeSelfSignedCert(t, dir, "ca")
+	config := testConfiguration()
+	config.SslClientCertFilePath = certFilePath
+	config.SslClientKeyFilePath = keyFilePath
+	config.SslClientCAFilePath = caCertFilePath
+	_, addr := startTestServer(t, config, storage.NewMemoryBackend())
+	return client.ClientConfiguration{ServerAddrAndPort: addr, SslClientCertFilePath: certFilePath}, caCertFilePath, caKeyFilePath
+}
+
+// withIdentity config presenting a certificate for commonName signed by the ca
+func withIdentity(t *testing.T, config client.ClientConfiguration, dir string, commonName string, caCertFilePath string, caKeyFilePath string) client.ClientConfiguration {
+	t.Helper()
+	config.SslIdentityCertFilePath, config.SslIdentityKeyFilePath = writeCert(t, dir, commonName, caCertFilePath, caKeyFilePath)
+	return config
+}
+
+func TestMutualTLSRefusesUnverifiedClients(t *testing.T) {
+	dir := t.TempDir()
+	config, caCertFilePath, caKeyFilePath := mutualTLSTestServer(t, dir)
+	otherCACertFilePath, otherCAKeyFilePath := writeSelfSignedCert(t, dir, "otherca")
+
+	tests := []struct {
+		name   string
+		config client.ClientConfiguration
+	}{
+		{"no client cert", config},
+		{"client cert from another ca", withIdentity(t, config, dir, "mallory", otherCACertFilePath, otherCAKeyFilePath)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			c := client.NewClient(test.config)
+			// with tls 1.3 the client can finish its side of the handshake
+			// before the server refuses it, so the refusal may only show up
+			// once the client tries to use the connection
+			if err := c.Connect(ctx); err != nil {
+				return
+			}
+			if _, err := c.CreateBucket(ctx, "", 10, 0); err == nil {
+				t.Fatal("server accepted a client without a verified certificate")
+			}
+		})
+	}
+
+	c := connectTestClient(t, withIdentity(t, config, dir, "alice", caCertFilePath, caKeyFilePath))
+	name, err := c.CreateBucket(context.Background(), "", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := c.StatBucket(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Owner != "CN=alice" {
+		t.Fatalf("expected the bucket to be owned by the client certificate subject got %q", info.Owner)
+	}
+}
+
+func TestBucketsForbiddenToOtherOwners(t *testing.T) {
+	dir := t.TempDir()
+	config, caCertFilePath, caKeyFilePath := mutualTLSTestServer(t, dir)
+	alice := connectTestClient(t, withIdentity(t, config, dir, "alice", caCertFilePath, caKeyFilePath))
+	bob := connectTestClient(t, withIdentity(t, config, dir, "bob", caCertFilePath, caKeyFilePath))
+	ctx := context.Background()
+
+	name, err := alice.CreateBucket(ctx, "", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.PutReaderInBucket(ctx, name, strings.NewReader("hello"), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{"stat", func() error {
+			_, err := bob.StatBucket(ctx, name)
+			return err
+		}},
+		{"get", func() error {
+			return bob.PutBucketInWriter(ctx, name, ioutil.Discard, false)
+		}},
+		{"put", func() error {
+			return bob.PutReaderInBucket(ctx, name, strings.NewReader("bye"), "")
+		}},
+		{"delete", func() error {
+			return bob.DeleteBucket(ctx, name)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.call(); !errors.Is(err, client.ErrForbidden) {
+				t.Fatalf("expected forbidden got %v", err)
+			}
+		})
+	}
+
+	buckets, err := bob.ListBuckets(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 0 {
+		t.Fatalf("expected another owner's bucket to be left out of the list got %#v", buckets)
+	}
+	var contents bytes.Buffer
+	if err := alice.PutBucketInWriter(ctx, name, &contents, false); err != nil {
+		t.Fatal(err)
+	}
+	if contents.String() != "hello" {
+		t.Fatalf("expected the owner's contents to be untouched got %q", contents.String())
+	}
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/genesis32/loft/storage"
+	"github.com/genesis32/loft/util"
+)
+
+// version1Conn speaks protocol version 1 to the server the way a client from
+// before version 2 does
+type version1Conn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+func dialVersion1(t *testing.T, addr string) *version1Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	c := &version1Conn{t: t, conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	c.send(util.Hello{
+		Header:     c.header(util.HelloMessageType),
+		MinVersion: util.ProtocolVersion1,
+		MaxVersion: util.ProtocolVersion1,
+	})
+	helloAck, ok := c.receive().(util.HelloAck)
+	if !ok || helloAck.ErrorCode != util.ErrorCodeNone || helloAck.SelectedVersion != util.ProtocolVersion1 {
+		t.Fatalf("server did not accept version 1 got %#v", helloAck)
+	}
+	return c
+}
+
+func (c *version1Conn) header(messageType int32) util.Header {
+	return util.Header{MessageType: messageType, Version: util.ProtocolVersion1}
+}
+
+func (c *version1Conn) send(message interface{}) {
+	c.t.Helper()
+	if err := util.WriteMessageToWriter(c.w, message); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *version1Conn) receive() interface{} {
+	c.t.Helper()
+	message, err := util.ReadMessageFromReader(c.r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return message
+}
+
+func TestVersion1UploadAndDownload(t *testing.T) {
+	_, addr := startTestServer(t, testConfiguration(), storage.NewMemoryBackend())
+	c := dialVersion1(t, addr)
+
+	c.send(util.BucketGenerateRequest{Header: c.header(util.BucketGenerateMessageType), NumBytesInBucket: 10})
+	generated, ok := c.receive().(util.BucketGenerateResponse)
+	if !ok || generated.ErrorCode != util.ErrorCodeNone {
+		t.Fatalf("failed to create a bucket got %#v", generated)
+	}
+	name := generated.UniqueIdentifier
+	if len(name) != util.BucketNameLengthV1 {
+		t.Fatalf("expected a %d character name for a version 1 client got %q", util.BucketNameLengthV1, name)
+	}
+
+	c.send(util.BucketPutBytesRequest{Header: c.header(util.BucketPutBytesMessageType), UniqueIdentifier: name, NumBytes: 5})
+	if put, ok := c.receive().(util.BucketPutBytesResponse); !ok || put.ErrorCode != util.ErrorCodeNone {
+		t.Fatalf("upload refused got %#v", put)
+	}
+	if _, err := c.w.WriteString("hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server still checksums uploads from version 1 clients
+	c.send(util.BucketStatRequest{Header: c.header(util.BucketStatMessageType), UniqueIdentifier: name})
+	stat, ok := c.receive().(util.BucketStatResponse)
+	if !ok || stat.ErrorCode != util.ErrorCodeNone || stat.Bucket.Size != 5 || stat.Checksum == "" {
+		t.Fatalf("unexpected stat of a version 1 upload %#v", stat)
+	}
+
+	// version 1 requests carry no range so the whole bucket comes back
+	c.send(util.BucketGetBytesRequest{Header: c.header(util.BucketGetBytesMessageType), UniqueIdentifier: name, Length: -1})
+	get, ok := c.receive().(util.BucketGetBytesResponse)
+	if !ok || get.ErrorCode != util.ErrorCodeNone || get.Size != 5 || get.ContentLength != 5 {
+		t.Fatalf("unexpected version 1 download response %#v", get)
+	}
+	contents := make([]byte, get.Size)
+	if _, err := io.ReadFull(c.r, contents); err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "hello" {
+		t.Fatalf("expected hello got %q", contents)
+	}
+}
+
+func TestVersion1NeverSeesExpiry(t *testing.T) {
+	backend := storage.NewMemoryBackend()
+	_, addr := startTestServer(t, testConfiguration(), backend)
+	c := dialVersion1(t, addr)
+	c.send(util.BucketGenerateRequest{Header: c.header(util.BucketGenerateMessageType), NumBytesInBucket: 10})
+	generated, ok := c.receive().(util.BucketGenerateResponse)
+	if !ok || generated.ErrorCode != util.ErrorCodeNone {
+		t.Fatalf("failed to create a bucket got %#v", generated)
+	}
+	name := generated.UniqueIdentifier
+	// given an expiry by a version 2 client
+	metadata, err := backend.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata.ExpiresAt = time.Now().Add(time.Hour)
+	if err := backend.UpdateMetadata(name, metadata); err != nil {
+		t.Fatal(err)
+	}
+
+	// receive refuses messages with bytes a version 1 decoder leaves over
+	c.send(util.BucketStatRequest{Header: c.header(util.BucketStatMessageType), UniqueIdentifier: name})
+	stat, ok := c.receive().(util.BucketStatResponse)
+	if !ok || stat.ErrorCode != util.ErrorCodeNone || stat.Bucket.ExpiresAt != 0 {
+		t.Fatalf("unexpected version 1 stat of an expiring bucket %#v", stat)
+	}
+	c.send(util.BucketListRequest{Header: c.header(util.BucketListMessageType)})
+	list, ok := c.receive().(util.BucketListResponse)
+	if !ok || list.ErrorCode != util.ErrorCodeNone || len(list.Buckets) != 1 || list.Buckets[0].ExpiresAt != 0 {
+		t.Fatalf("unexpected version 1 list of an expiring bucket %#v", list)
+	}
+
+	// a version 1 client cannot even encode an extend, so send one by hand
+	extend, err := util.SerializeMessage2(util.BucketExtendRequest{
+		Header:           util.Header{MessageType: util.BucketExtendMessageType, Version: util.ProtocolVersion2},
+		UniqueIdentifier: name,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := extend.Bytes()
+	binary.BigEndian.PutUint32(payload[4:8], uint32(util.ProtocolVersion1))
+	if err := util.WriteFrame(c.w, util.FrameTypeMessage, payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if refused, ok := c.receive().(util.ErrorResponse); !ok || refused.ErrorCode != util.ErrorCodeMalformedMessage {
+		t.Fatalf("expected the version 1 extend to be refused got %#v", refused)
+	}
+	if current, err := backend.Stat(name); err != nil || !current.ExpiresAt.Equal(metadata.ExpiresAt) {
+		t.Fatalf("expected the expiry to be unchanged got %v error: %v", current.ExpiresAt, err)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package storage
+
+// diskFree is not known on this platform
+func diskFree(dirPath string) (int64, bool, error) {
+	return 0, false, nil
+}
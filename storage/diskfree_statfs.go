@@ -0,0 +1,20 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package storage
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// diskFree the bytes an unprivileged user can still write to the filesystem
+// holding dirPath
+func diskFree(dirPath string) (int64, bool, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dirPath, &stat); err != nil {
+		return 0, false, errors.Wrapf(err, "failed to stat filesystem of %s", dirPath)
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), true, nil
+}
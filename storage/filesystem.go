@@ -0,0 +1,715 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	metadataSuffix = ".meta"
+	uploadSuffix   = ".upload"
+	contentSuffix  = ".data"
+	// namespaceFile records the owner of a namespace in its directory
+	namespaceFile = ".namespace"
+)
+
+// openReaderAttempts how many times OpenReader tries to catch the contents and
+// metadata of a bucket from the same upload
+const openReaderAttempts = 3
+
+// FilesystemBackend keeps each bucket as json metadata in a file under a
+// directory, next to a file per generation of its contents. A bucket exists
+// for as long as its metadata does and the metadata names the generation
+// holding its contents. New contents are written to a hidden temp file in the
+// same directory, renamed to a new generation once complete and switched to by
+// replacing the metadata. Buckets from before generations keep their contents
+// in a file named after the bucket. A namespaced bucket lives in a directory
+// named after its namespace.
+type FilesystemBackend struct {
+	root string
+	// mu keeps metadata updates from switching a bucket back to a generation
+	// a commit is replacing
+	mu sync.Mutex
+	// commitHook is called after each step of a commit so tests can stop
+	// part way through
+	commitHook func(step string)
+}
+
+// filesystemMetadata the metadata as stored on disk. ID is picked when the
+// bucket is created and tells it apart from a bucket of the same name that
+// was deleted. Buckets from before IDs have none.
+type filesystemMetadata struct {
+	Metadata
+	Generation string `json:"generation,omitempty"`
+	ID         string `json:"id,omitempty"`
+}
+
+// NewFilesystemBackend stores buckets under root, which must be a directory
+func NewFilesystemBackend(root string) (*FilesystemBackend, error) {
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid bucket path")
+	}
+	if !stat.IsDir() {
+		return nil, errors.Errorf("bucket path: %s is not a directory", root)
+	}
+
+	backend := &FilesystemBackend{root: root}
+	if err := backend.sweepTempFiles(); err != nil {
+		return nil, err
+	}
+	if err := backend.migrateMetadata(); err != nil {
+		return nil, err
+	}
+	if err := backend.removeStaleGenerations(); err != nil {
+		return nil, err
+	}
+	return backend, nil
+}
+
+// checkName refuses names that could reach outside the root or be mistaken
+// for the metadata and temp files kept next to the buckets. Only a single
+// namespace directory is allowed. Callers are expected to have validated
+// names already, this is the last line of defence.
+func checkName(name string) error {
+	parts := strings.Split(name, "/")
+	if len(parts) > 2 {
+		return errors.Wrapf(ErrInvalidName, "%q", name)
+	}
+	for _, part := range parts {
+		if part == "" || strings.ContainsAny(part, ".\\\x00") {
+			return errors.Wrapf(ErrInvalidName, "%q", name)
+		}
+	}
+	return nil
+}
+
+// tempFile creates a hidden file next to the bucket for new contents or
+// metadata
+func (b *FilesystemBackend) tempFile(name string, suffix string) (*os.File, error) {
+	bucketPath := b.bucketPath(name)
+	return ioutil.TempFile(path.Dir(bucketPath), "."+path.Base(bucketPath)+suffix)
+}
+
+func (b *FilesystemBackend) bucketPath(name string) string {
+	return path.Join(b.root, name)
+}
+
+func (b *FilesystemBackend) metadataPath(name string) string {
+	return b.bucketPath(name) + metadataSuffix
+}
+
+// contentPath the file holding a generation of the contents. Names cannot
+// contain a '.' so these never collide with another bucket.
+func (b *FilesystemBackend) contentPath(name string, generation string) string {
+	if generation == "" {
+		return b.bucketPath(name)
+	}
+	return b.bucketPath(name) + "." + generation + contentSuffix
+}
+
+func newGeneration() (string, error) {
+	generation := make([]byte, 8)
+	if _, err := rand.Read(generation); err != nil {
+		return "", errors.Wrap(err, "failed to generate contents generation")
+	}
+	return hex.EncodeToString(generation), nil
+}
+
+func (b *FilesystemBackend) commitStep(step string) {
+	if b.commitHook != nil {
+		b.commitHook(step)
+	}
+}
+
+// Create links the metadata into place so only one of two creates under the
+// same name succeeds
+func (b *FilesystemBackend) Create(name string, metadata Metadata) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if dir := path.Dir(b.bucketPath(name)); dir != path.Clean(b.root) {
+		if _, err := os.Stat(b.metadataPath(path.Base(dir))); err == nil {
+			return errors.Wrapf(ErrExists, "namespace of %s is a bucket", name)
+		}
+		err := os.MkdirAll(dir, 0755)
+		if err != nil && isNotDir(dir) {
+			return errors.Wrapf(ErrExists, "namespace of %s is a bucket", name)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to create namespace of bucket %s", name)
+		}
+	} else if fileInfo, err := os.Stat(b.bucketPath(name)); err == nil && fileInfo.IsDir() {
+		return errors.Wrapf(ErrExists, "bucket %s is a namespace", name)
+	}
+
+	generation, err := newGeneration()
+	if err != nil {
+		return err
+	}
+	id, err := newGeneration()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(b.contentPath(name, generation), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create bucket %s", name)
+	}
+	f.Close()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	metadataFile, err := b.writeMetadataFile(name, filesystemMetadata{Metadata: metadata, Generation: generation, ID: id})
+	if err != nil {
+		os.Remove(b.contentPath(name, generation))
+		return err
+	}
+	defer os.Remove(metadataFile)
+	err = os.Link(metadataFile, b.metadataPath(name))
+	if os.IsExist(err) {
+		os.Remove(b.contentPath(name, generation))
+		return ErrExists
+	}
+	if err != nil {
+		os.Remove(b.contentPath(name, generation))
+		return errors.Wrapf(err, "failed to create metadata for bucket %s", name)
+	}
+	b.syncDir(name)
+	return nil
+}
+
+// OpenReader the open file keeps the contents it was opened with when a
+// commit removes its generation. A commit landing between reading the
+// metadata and opening the generation it names is retried.
+func (b *FilesystemBackend) OpenReader(name string, offset int64, length int64) (io.ReadCloser, Metadata, error) {
+	for attempt := 0; attempt < openReaderAttempts; attempt++ {
+		f, metadata, err := b.openBucket(name)
+		if err != nil {
+			return nil, metadata, err
+		}
+		if f == nil {
+			continue
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, metadata, errors.Wrapf(err, "failed to seek bucket %s", name)
+		}
+		if length < 0 {
+			return f, metadata, nil
+		}
+		return &limitedReadCloser{Reader: io.LimitReader(f, length), Closer: f}, metadata, nil
+	}
+	return nil, Metadata{}, errors.Errorf("contents of bucket %s do not match its metadata", name)
+}
+
+// openBucket returns a nil file when the generation named by the metadata was
+// replaced before it could be opened
+func (b *FilesystemBackend) openBucket(name string) (*os.File, Metadata, error) {
+	metadata, err := b.readMetadata(name)
+	if err != nil {
+		return nil, metadata.Metadata, err
+	}
+	f, err := os.Open(b.contentPath(name, metadata.Generation))
+	if os.IsNotExist(err) {
+		return nil, metadata.Metadata, nil
+	}
+	if err != nil {
+		return nil, metadata.Metadata, errors.Wrapf(err, "failed to open bucket %s", name)
+	}
+	return f, metadata.Metadata, nil
+}
+
+// OpenWriter the upload is only committed to the bucket it was opened for,
+// not to another created under the same name in the meantime
+func (b *FilesystemBackend) OpenWriter(name string) (Writer, error) {
+	metadata, err := b.readMetadata(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := b.tempFile(name, uploadSuffix)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create upload for bucket %s", name)
+	}
+	return &filesystemWriter{backend: b, name: name, id: metadata.ID, file: f}, nil
+}
+
+func (b *FilesystemBackend) Stat(name string) (Metadata, error) {
+	metadata, err := b.readMetadata(name)
+	return metadata.Metadata, err
+}
+
+func (b *FilesystemBackend) readMetadata(name string) (filesystemMetadata, error) {
+	var metadata filesystemMetadata
+	if err := checkName(name); err != nil {
+		return metadata, err
+	}
+	metadataBytes, err := ioutil.ReadFile(b.metadataPath(name))
+	if os.IsNotExist(err) {
+		return metadata, ErrNotFound
+	}
+	if err != nil {
+		return metadata, errors.Wrapf(err, "failed to read metadata for bucket %s", name)
+	}
+	if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
+		return metadata, errors.Wrapf(err, "corrupt metadata for bucket %s", name)
+	}
+	return metadata, nil
+}
+
+// UpdateMetadata keeps the bucket on the generation of the contents it has
+func (b *FilesystemBackend) UpdateMetadata(name string, metadata Metadata) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	current, err := b.readMetadata(name)
+	if err != nil {
+		return err
+	}
+	return b.writeMetadata(name, filesystemMetadata{Metadata: metadata, Generation: current.Generation, ID: current.ID})
+}
+
+// writeMetadata replaces the metadata through a rename so readers never see a
+// partially written file
+func (b *FilesystemBackend) writeMetadata(name string, metadata filesystemMetadata) error {
+	metadataFile, err := b.writeMetadataFile(name, metadata)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(metadataFile, b.metadataPath(name)); err != nil {
+		os.Remove(metadataFile)
+		return errors.Wrapf(err, "failed to replace metadata for bucket %s", name)
+	}
+	return nil
+}
+
+// writeMetadataFile writes the metadata to a temp file next to the bucket and
+// returns its path
+func (b *FilesystemBackend) writeMetadataFile(name string, metadata filesystemMetadata) (string, error) {
+	metadataBytes, err := json.Marshal(metadata)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to serialize metadata for bucket %s", name)
+	}
+
+	f, err := b.tempFile(name, metadataSuffix)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create metadata for bucket %s", name)
+	}
+	if _, err := f.Write(metadataBytes); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", errors.Wrapf(err, "failed to write metadata for bucket %s", name)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", errors.Wrapf(err, "failed to sync metadata for bucket %s", name)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", errors.Wrapf(err, "failed to close metadata for bucket %s", name)
+	}
+	return f.Name(), nil
+}
+
+// Delete removes the metadata before the generation it names so the bucket
+// is gone even if its contents cannot be removed. Contents from before
+// generations go first instead, left alone they would look like a bucket from
+// before metadata and be migrated back.
+func (b *FilesystemBackend) Delete(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	metadata, err := b.readMetadata(name)
+	if err != nil {
+		return err
+	}
+	contentPath := b.contentPath(name, metadata.Generation)
+	if metadata.Generation == "" {
+		if err := os.Remove(contentPath); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "failed to remove bucket %s", name)
+		}
+	}
+	if err := os.Remove(b.metadataPath(name)); err != nil {
+		return errors.Wrapf(err, "failed to remove metadata of bucket %s", name)
+	}
+	if err := os.Remove(contentPath); err != nil && !os.IsNotExist(err) {
+		log.Printf("failed to remove contents of deleted bucket %s. error: %v", name, err)
+	}
+	// an unclaimed namespace goes with its last bucket, it is not empty
+	// otherwise
+	if dir := path.Dir(b.bucketPath(name)); dir != path.Clean(b.root) {
+		os.Remove(dir)
+	}
+	return nil
+}
+
+// isNotDir reports whether something other than a directory is at dirPath
+func isNotDir(dirPath string) bool {
+	fileInfo, err := os.Stat(dirPath)
+	return err == nil && !fileInfo.IsDir()
+}
+
+// FreeSpace the room left on the disk holding the buckets
+func (b *FilesystemBackend) FreeSpace() (int64, bool, error) {
+	return diskFree(b.root)
+}
+
+func (b *FilesystemBackend) List() ([]string, error) {
+	names, err := listDir(b.root, "")
+	if err != nil {
+		return nil, err
+	}
+	// namespaces and top level buckets are listed separately
+	sort.Strings(names)
+	return names, nil
+}
+
+// listDir the buckets in dir, descending into namespaces when prefix is empty
+func listDir(dir string, prefix string) ([]string, error) {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list buckets")
+	}
+	names := []string{}
+	for _, fileInfo := range fileInfos {
+		if strings.HasPrefix(fileInfo.Name(), ".") {
+			continue
+		}
+		if fileInfo.IsDir() {
+			if prefix != "" {
+				continue
+			}
+			namespaceNames, err := listDir(path.Join(dir, fileInfo.Name()), fileInfo.Name()+"/")
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, namespaceNames...)
+			continue
+		}
+		if !strings.HasSuffix(fileInfo.Name(), metadataSuffix) {
+			continue
+		}
+		names = append(names, prefix+strings.TrimSuffix(fileInfo.Name(), metadataSuffix))
+	}
+	return names, nil
+}
+
+// namespaceRecord what is stored about a namespace
+type namespaceRecord struct {
+	Owner string `json:"owner"`
+}
+
+func (b *FilesystemBackend) namespacePath(namespace string) (string, error) {
+	if err := checkName(namespace); err != nil || strings.Contains(namespace, "/") {
+		return "", errors.Wrapf(ErrInvalidName, "namespace %q", namespace)
+	}
+	return path.Join(b.root, namespace), nil
+}
+
+func (b *FilesystemBackend) NamespaceOwner(namespace string) (string, bool, error) {
+	dir, err := b.namespacePath(namespace)
+	if err != nil {
+		return "", false, err
+	}
+	recordBytes, err := ioutil.ReadFile(path.Join(dir, namespaceFile))
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, errors.Wrapf(err, "failed to read owner of namespace %s", namespace)
+	}
+	var record namespaceRecord
+	if err := json.Unmarshal(recordBytes, &record); err != nil {
+		return "", false, errors.Wrapf(err, "corrupt owner of namespace %s", namespace)
+	}
+	return record.Owner, true, nil
+}
+
+// ClaimNamespace links the record into place so only the first claim
+// succeeds. The record keeps the directory from being removed with the last
+// bucket in it.
+func (b *FilesystemBackend) ClaimNamespace(namespace string, owner string) error {
+	dir, err := b.namespacePath(namespace)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create namespace %s", namespace)
+	}
+	recordBytes, err := json.Marshal(namespaceRecord{Owner: owner})
+	if err != nil {
+		return errors.Wrapf(err, "failed to serialize owner of namespace %s", namespace)
+	}
+	// named so sweepTempFiles removes it if the server stops part way
+	f, err := ioutil.TempFile(dir, namespaceFile+metadataSuffix)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create owner of namespace %s", namespace)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(recordBytes); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "failed to write owner of namespace %s", namespace)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "failed to sync owner of namespace %s", namespace)
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "failed to close owner of namespace %s", namespace)
+	}
+	err = os.Link(f.Name(), path.Join(dir, namespaceFile))
+	if os.IsExist(err) {
+		return ErrExists
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to record owner of namespace %s", namespace)
+	}
+	return nil
+}
+
+// syncDir makes renames in the directory of the bucket durable. Not every
+// platform can sync a directory so failures are only logged.
+func (b *FilesystemBackend) syncDir(name string) {
+	dir, err := os.Open(path.Dir(b.bucketPath(name)))
+	if err != nil {
+		log.Printf("failed to open bucket path for sync. error: %v", err)
+		return
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		log.Printf("failed to sync bucket path. error: %v", err)
+	}
+}
+
+// sweepTempFiles removes uploads and metadata updates left behind when the
+// server stopped part way through writing them
+func (b *FilesystemBackend) sweepTempFiles() error {
+	return sweepTempFilesIn(b.root, true)
+}
+
+func sweepTempFilesIn(dir string, namespaces bool) error {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Wrap(err, "failed to read bucket path")
+	}
+	for _, fileInfo := range fileInfos {
+		name := fileInfo.Name()
+		if fileInfo.IsDir() && namespaces && !strings.HasPrefix(name, ".") {
+			if err := sweepTempFilesIn(path.Join(dir, name), false); err != nil {
+				return err
+			}
+			continue
+		}
+		if fileInfo.IsDir() || !strings.HasPrefix(name, ".") {
+			continue
+		}
+		if !strings.Contains(name, uploadSuffix) && !strings.Contains(name, metadataSuffix) {
+			continue
+		}
+		if err := os.Remove(path.Join(dir, name)); err != nil {
+			return errors.Wrapf(err, "failed to remove stale temp file %s", name)
+		}
+		log.Printf("removed stale temp file %s", name)
+	}
+	return nil
+}
+
+// migrateMetadata writes metadata for buckets created before it was stored,
+// folding in the .owner files that used to record ownership. Those buckets
+// were truncated to their capacity so the file size is used for both the
+// capacity and the content length.
+func (b *FilesystemBackend) migrateMetadata() error {
+	fileInfos, err := ioutil.ReadDir(b.root)
+	if err != nil {
+		return errors.Wrap(err, "failed to read bucket path")
+	}
+	for _, fileInfo := range fileInfos {
+		name := fileInfo.Name()
+		if fileInfo.IsDir() || strings.Contains(name, ".") {
+			continue
+		}
+		if _, err := os.Stat(b.metadataPath(name)); err == nil || !os.IsNotExist(err) {
+			continue
+		}
+
+		ownerPath := b.bucketPath(name) + ".owner"
+		owner, err := ioutil.ReadFile(ownerPath)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "failed to read owner of bucket %s", name)
+		}
+		metadata := Metadata{
+			Capacity:      fileInfo.Size(),
+			ContentLength: fileInfo.Size(),
+			CreatedAt:     fileInfo.ModTime(),
+			UpdatedAt:     fileInfo.ModTime(),
+			Owner:         string(owner),
+		}
+		if err := b.writeMetadata(name, filesystemMetadata{Metadata: metadata}); err != nil {
+			return err
+		}
+		os.Remove(ownerPath)
+		log.Printf("migrated bucket %s to metadata", name)
+	}
+	return nil
+}
+
+// removeStaleGenerations removes contents no metadata refers to, left behind
+// when the server stopped part way through creating, replacing or deleting a
+// bucket. It also finishes deleting buckets from before generations whose
+// contents were removed but not their metadata.
+func (b *FilesystemBackend) removeStaleGenerations() error {
+	return b.removeStaleGenerationsIn(b.root, "")
+}
+
+func (b *FilesystemBackend) removeStaleGenerationsIn(dir string, prefix string) error {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Wrap(err, "failed to read bucket path")
+	}
+	for _, fileInfo := range fileInfos {
+		fileName := fileInfo.Name()
+		if strings.HasPrefix(fileName, ".") {
+			continue
+		}
+		if fileInfo.IsDir() {
+			if prefix != "" {
+				continue
+			}
+			if err := b.removeStaleGenerationsIn(path.Join(dir, fileName), fileName+"/"); err != nil {
+				return err
+			}
+			continue
+		}
+		if strings.HasSuffix(fileName, metadataSuffix) {
+			name := prefix + strings.TrimSuffix(fileName, metadataSuffix)
+			if err := b.finishLegacyDelete(name); err != nil {
+				return err
+			}
+			continue
+		}
+		// legacy contents are named after the bucket
+		name, generation := fileName, ""
+		if strings.HasSuffix(fileName, contentSuffix) {
+			parts := strings.Split(strings.TrimSuffix(fileName, contentSuffix), ".")
+			if len(parts) != 2 {
+				continue
+			}
+			name, generation = parts[0], parts[1]
+		} else if strings.Contains(fileName, ".") {
+			continue
+		}
+		metadata, err := b.readMetadata(prefix + name)
+		if err == nil && metadata.Generation == generation {
+			continue
+		}
+		if err != nil && err != ErrNotFound {
+			log.Printf("keeping contents %s of unreadable bucket. error: %v", prefix+fileName, err)
+			continue
+		}
+		if err := os.Remove(path.Join(dir, fileName)); err != nil {
+			return errors.Wrapf(err, "failed to remove stale contents %s", fileName)
+		}
+		log.Printf("removed stale contents %s", prefix+fileName)
+	}
+	return nil
+}
+
+func (b *FilesystemBackend) finishLegacyDelete(name string) error {
+	// unreadable metadata is left for the operator
+	metadata, err := b.readMetadata(name)
+	if err != nil || metadata.Generation != "" {
+		return nil
+	}
+	if _, err := os.Stat(b.contentPath(name, "")); !os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.Remove(b.metadataPath(name)); err != nil {
+		return errors.Wrapf(err, "failed to remove metadata of deleted bucket %s", name)
+	}
+	log.Printf("finished deleting bucket %s", name)
+	return nil
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type filesystemWriter struct {
+	backend *FilesystemBackend
+	name    string
+	// id of the bucket the upload was opened for
+	id   string
+	file *os.File
+}
+
+func (w *filesystemWriter) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+// Commit renames the upload to a new generation and then points the
+// metadata at it. Replacing the metadata is the one step that switches the
+// bucket over, so a crash at any point leaves either the old or the new
+// contents in place.
+func (w *filesystemWriter) Commit(metadata Metadata) error {
+	if err := w.file.Sync(); err != nil {
+		w.Abort()
+		return errors.Wrapf(err, "failed to sync upload for bucket %s", w.name)
+	}
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return errors.Wrapf(err, "failed to close upload for bucket %s", w.name)
+	}
+	generation, err := newGeneration()
+	if err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+
+	b := w.backend
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// a bucket deleted during the upload stays deleted, even if another has
+	// been created under its name since
+	current, err := b.readMetadata(w.name)
+	if err == nil && current.ID != w.id {
+		err = ErrNotFound
+	}
+	if err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	contentPath := b.contentPath(w.name, generation)
+	if err := os.Rename(w.file.Name(), contentPath); err != nil {
+		os.Remove(w.file.Name())
+		return errors.Wrapf(err, "failed to replace bucket %s", w.name)
+	}
+	b.commitStep("contents")
+	if err := b.writeMetadata(w.name, filesystemMetadata{Metadata: metadata, Generation: generation, ID: current.ID}); err != nil {
+		os.Remove(contentPath)
+		return err
+	}
+	b.syncDir(w.name)
+	b.commitStep("metadata")
+	if err := os.Remove(b.contentPath(w.name, current.Generation)); err != nil && !os.IsNotExist(err) {
+		log.Printf("failed to remove replaced contents of bucket %s. error: %v", w.name, err)
+	}
+	return nil
+}
+
+func (w *filesystemWriter) Abort() error {
+	w.file.Close()
+	if err := os.Remove(w.file.Name()); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove upload for bucket %s", w.name)
+	}
+	return nil
+}
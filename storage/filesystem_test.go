@@ -0,0 +1,330 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func newTestFilesystemBackend(t *testing.T, root string) *FilesystemBackend {
+	t.Helper()
+	backend, err := NewFilesystemBackend(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+func writeBucket(t *testing.T, backend Backend, name string, contents string) {
+	t.Helper()
+	w, err := backend.OpenWriter(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(contents)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(Metadata{Capacity: 10, ContentLength: int64(len(contents))}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readBucket(t *testing.T, backend Backend, name string) (string, Metadata) {
+	t.Helper()
+	r, metadata, err := backend.OpenReader(name, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents), metadata
+}
+
+// dirNames the files in dir in sorted order
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, fileInfo := range fileInfos {
+		names = append(names, fileInfo.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestCommitInterruptedLeavesOneVersion(t *testing.T) {
+	tests := []struct {
+		step     string
+		contents string
+	}{
+		{"contents", "old"},
+		{"metadata", "newer"},
+	}
+	for _, test := range tests {
+		t.Run(test.step, func(t *testing.T) {
+			root := t.TempDir()
+			backend := newTestFilesystemBackend(t, root)
+			if err := backend.Create("foo", Metadata{Capacity: 10}); err != nil {
+				t.Fatal(err)
+			}
+			writeBucket(t, backend, "foo", "old")
+
+			// the server stops dead after the step
+			backend.commitHook = func(step string) {
+				if step == test.step {
+					panic(step)
+				}
+			}
+			func() {
+				defer func() {
+					if recover() == nil {
+						t.Fatalf("commit did not reach step %s", test.step)
+					}
+				}()
+				writeBucket(t, backend, "foo", "newer")
+			}()
+
+			restarted := newTestFilesystemBackend(t, root)
+			contents, metadata := readBucket(t, restarted, "foo")
+			if contents != test.contents || metadata.ContentLength != int64(len(test.contents)) {
+				t.Fatalf("expected %q got %q with content length %d", test.contents, contents, metadata.ContentLength)
+			}
+			names := dirNames(t, root)
+			if len(names) != 2 || !strings.HasSuffix(names[0], contentSuffix) || names[1] != "foo.meta" {
+				t.Fatalf("expected only the metadata and one generation got %v", names)
+			}
+		})
+	}
+}
+
+func TestCreateInterruptedLeavesNoContents(t *testing.T) {
+	root := t.TempDir()
+	// contents of a create that stopped before its metadata was linked
+	if err := ioutil.WriteFile(path.Join(root, "foo.0123456789abcdef"+contentSuffix), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	backend := newTestFilesystemBackend(t, root)
+	if names := dirNames(t, root); len(names) != 0 {
+		t.Fatalf("expected stale contents to be removed got %v", names)
+	}
+	if err := backend.Create("foo", Metadata{Capacity: 10}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLegacyBucketMovesToGenerationOnCommit(t *testing.T) {
+	root := t.TempDir()
+	if err := ioutil.WriteFile(path.Join(root, "foo"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(root, "foo.meta"), []byte(`{"capacity":10,"content_length":3}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	backend := newTestFilesystemBackend(t, root)
+	if contents, _ := readBucket(t, backend, "foo"); contents != "old" {
+		t.Fatalf("expected old got %q", contents)
+	}
+
+	writeBucket(t, backend, "foo", "newer")
+	if contents, _ := readBucket(t, backend, "foo"); contents != "newer" {
+		t.Fatalf("expected newer got %q", contents)
+	}
+	if _, err := os.Stat(path.Join(root, "foo")); !os.IsNotExist(err) {
+		t.Fatalf("expected the legacy contents to be removed. error: %v", err)
+	}
+}
+
+func TestLegacyDeleteInterruptedIsFinished(t *testing.T) {
+	root := t.TempDir()
+	// a delete that removed the legacy contents but not the metadata
+	if err := ioutil.WriteFile(path.Join(root, "foo.meta"), []byte(`{"capacity":10,"content_length":3}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	backend := newTestFilesystemBackend(t, root)
+	if _, err := backend.Stat("foo"); err != ErrNotFound {
+		t.Fatalf("expected the bucket to be gone got %v", err)
+	}
+}
+
+func TestCreateRefusesBucketAndNamespaceOfSameName(t *testing.T) {
+	backend := newTestFilesystemBackend(t, t.TempDir())
+	if err := backend.Create("foo", Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Create("foo/bar", Metadata{}); errors.Cause(err) != ErrExists {
+		t.Fatalf("expected a namespace named after a bucket to exist got %v", err)
+	}
+	if err := backend.Create("baz/bar", Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Create("baz", Metadata{}); errors.Cause(err) != ErrExists {
+		t.Fatalf("expected a bucket named after a namespace to exist got %v", err)
+	}
+	if err := backend.Create("foo", Metadata{}); err != ErrExists {
+		t.Fatalf("expected foo to exist got %v", err)
+	}
+}
+
+func TestFilesystemBackendRefusesUnsafeNames(t *testing.T) {
+	parent := t.TempDir()
+	root := path.Join(parent, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	backend := newTestFilesystemBackend(t, root)
+	if err := backend.Create("b", Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"../x", "a/../b", "..", "a\x00b", "a\\b", "b.meta", "a/b/c", "", "/x", "x/"}
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			calls := map[string]error{}
+			calls["Create"] = backend.Create(name, Metadata{})
+			_, calls["Stat"] = backend.Stat(name)
+			_, _, calls["OpenReader"] = backend.OpenReader(name, 0, -1)
+			_, calls["OpenWriter"] = backend.OpenWriter(name)
+			calls["UpdateMetadata"] = backend.UpdateMetadata(name, Metadata{})
+			calls["Delete"] = backend.Delete(name)
+			for call, err := range calls {
+				if errors.Cause(err) != ErrInvalidName {
+					t.Errorf("expected %s of %q to be refused got %v", call, name, err)
+				}
+			}
+		})
+	}
+
+	if names := dirNames(t, parent); len(names) != 1 || names[0] != "root" {
+		t.Fatalf("expected nothing written outside the root got %v", names)
+	}
+	if names := dirNames(t, root); len(names) != 2 {
+		t.Fatalf("expected only bucket b in the root got %v", names)
+	}
+}
+
+func TestConcurrentCreateOfOneNameSucceedsOnce(t *testing.T) {
+	root := t.TempDir()
+	backend := newTestFilesystemBackend(t, root)
+	const creates = 20
+	errs := make(chan error, creates)
+	var wg sync.WaitGroup
+	for i := 0; i < creates; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- backend.Create("foo", Metadata{})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	created := 0
+	for err := range errs {
+		switch err {
+		case nil:
+			created++
+		case ErrExists:
+		default:
+			t.Fatal(err)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("expected one create to succeed got %d", created)
+	}
+	if names := dirNames(t, root); len(names) != 2 {
+		t.Fatalf("expected the losing creates to clean up after themselves got %v", names)
+	}
+}
+
+func TestNamespaceClaimSurvivesLastBucketAndRestart(t *testing.T) {
+	root := t.TempDir()
+	backend := newTestFilesystemBackend(t, root)
+	if _, claimed, err := backend.NamespaceOwner("team"); err != nil || claimed {
+		t.Fatalf("expected an unclaimed namespace got claimed:%v error: %v", claimed, err)
+	}
+	if err := backend.Create("team/a", Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.ClaimNamespace("team", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.ClaimNamespace("team", "bob"); err != ErrExists {
+		t.Fatalf("expected the second claim to fail got %v", err)
+	}
+	if err := backend.Delete("team/a"); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newTestFilesystemBackend(t, root)
+	owner, claimed, err := restarted.NamespaceOwner("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claimed || owner != "alice" {
+		t.Fatalf("expected alice to own the namespace got %q claimed:%v", owner, claimed)
+	}
+	if names, err := restarted.List(); err != nil || len(names) != 0 {
+		t.Fatalf("expected no buckets listed got %v error: %v", names, err)
+	}
+	if err := restarted.Create("team", Metadata{}); errors.Cause(err) != ErrExists {
+		t.Fatalf("expected a bucket named after the claimed namespace to exist got %v", err)
+	}
+}
+
+func TestCommitRefusedAfterBucketRecreated(t *testing.T) {
+	backends := map[string]func(t *testing.T) Backend{
+		"filesystem": func(t *testing.T) Backend { return newTestFilesystemBackend(t, t.TempDir()) },
+		"memory":     func(t *testing.T) Backend { return NewMemoryBackend() },
+	}
+	for backendName, newBackend := range backends {
+		t.Run(backendName, func(t *testing.T) {
+			backend := newBackend(t)
+			if err := backend.Create("foo", Metadata{Capacity: 10, Owner: "alice"}); err != nil {
+				t.Fatal(err)
+			}
+			w, err := backend.OpenWriter("foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write([]byte("alice")); err != nil {
+				t.Fatal(err)
+			}
+			if err := backend.Delete("foo"); err != nil {
+				t.Fatal(err)
+			}
+			if err := backend.Create("foo", Metadata{Capacity: 20, Owner: "bob"}); err != nil {
+				t.Fatal(err)
+			}
+
+			err = w.Commit(Metadata{Capacity: 10, ContentLength: 5, Owner: "alice"})
+			if err != ErrNotFound {
+				t.Fatalf("expected the upload to the deleted bucket to be refused got %v", err)
+			}
+			contents, metadata := readBucket(t, backend, "foo")
+			if contents != "" || metadata.Owner != "bob" || metadata.Capacity != 20 {
+				t.Fatalf("expected the new bucket to be untouched got %q %#v", contents, metadata)
+			}
+
+			// changing the metadata is not recreating the bucket
+			if err := backend.UpdateMetadata("foo", metadata); err != nil {
+				t.Fatal(err)
+			}
+			writeBucket(t, backend, "foo", "bob")
+			writeBucket(t, backend, "foo", "bob again")
+			if contents, _ := readBucket(t, backend, "foo"); contents != "bob again" {
+				t.Fatalf("expected uploads to the new bucket to commit got %q", contents)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+// MemoryBackend keeps buckets in memory. It is meant for tests and loses
+// everything when the server exits.
+type MemoryBackend struct {
+	mu         sync.Mutex
+	buckets    map[string]*memoryBucket
+	namespaces map[string]string
+}
+
+type memoryBucket struct {
+	metadata Metadata
+	contents []byte
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{buckets: map[string]*memoryBucket{}, namespaces: map[string]string{}}
+}
+
+func (b *MemoryBackend) Create(name string, metadata Metadata) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.buckets[name]; ok {
+		return ErrExists
+	}
+	b.buckets[name] = &memoryBucket{metadata: metadata}
+	return nil
+}
+
+func (b *MemoryBackend) OpenReader(name string, offset int64, length int64) (io.ReadCloser, Metadata, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bucket, ok := b.buckets[name]
+	if !ok {
+		return nil, Metadata{}, ErrNotFound
+	}
+	contents := bucket.contents
+	if offset > int64(len(contents)) {
+		offset = int64(len(contents))
+	}
+	contents = contents[offset:]
+	if length >= 0 && length < int64(len(contents)) {
+		contents = contents[:length]
+	}
+	return ioutil.NopCloser(bytes.NewReader(contents)), bucket.metadata, nil
+}
+
+func (b *MemoryBackend) OpenWriter(name string) (Writer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bucket, ok := b.buckets[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &memoryWriter{backend: b, name: name, bucket: bucket}, nil
+}
+
+func (b *MemoryBackend) Stat(name string) (Metadata, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bucket, ok := b.buckets[name]
+	if !ok {
+		return Metadata{}, ErrNotFound
+	}
+	return bucket.metadata, nil
+}
+
+func (b *MemoryBackend) UpdateMetadata(name string, metadata Metadata) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bucket, ok := b.buckets[name]
+	if !ok {
+		return ErrNotFound
+	}
+	bucket.metadata = metadata
+	return nil
+}
+
+func (b *MemoryBackend) Delete(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.buckets[name]; !ok {
+		return ErrNotFound
+	}
+	delete(b.buckets, name)
+	return nil
+}
+
+func (b *MemoryBackend) List() ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	names := make([]string, 0, len(b.buckets))
+	for name := range b.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (b *MemoryBackend) NamespaceOwner(namespace string) (string, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	owner, ok := b.namespaces[namespace]
+	return owner, ok, nil
+}
+
+func (b *MemoryBackend) ClaimNamespace(namespace string, owner string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.namespaces[namespace]; ok {
+		return ErrExists
+	}
+	b.namespaces[namespace] = owner
+	return nil
+}
+
+type memoryWriter struct {
+	backend *MemoryBackend
+	name    string
+	// bucket the upload was opened for, which a bucket created under the
+	// same name after it was deleted is not
+	bucket *memoryBucket
+	buf    bytes.Buffer
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *memoryWriter) Commit(metadata Metadata) error {
+	w.backend.mu.Lock()
+	defer w.backend.mu.Unlock()
+	bucket, ok := w.backend.buckets[w.name]
+	if !ok || bucket != w.bucket {
+		return ErrNotFound
+	}
+	bucket.contents = w.buf.Bytes()
+	bucket.metadata = metadata
+	return nil
+}
+
+func (w *memoryWriter) Abort() error {
+	w.buf.Reset()
+	return nil
+}
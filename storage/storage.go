@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNotFound    = errors.New("bucket not found")
+	ErrExists      = errors.New("bucket already exists")
+	ErrInvalidName = errors.New("invalid bucket name")
+)
+
+// Metadata everything stored about a bucket apart from its contents. The
+// capacity a bucket was created with is kept apart from the length of what
+// was last written to it. A zero ExpiresAt never expires.
+type Metadata struct {
+	Capacity      int64     `json:"capacity"`
+	ContentLength int64     `json:"content_length"`
+	ContentType   string    `json:"content_type,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	Owner         string    `json:"owner,omitempty"`
+	Checksum      string    `json:"checksum,omitempty"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+// Backend stores buckets and their metadata. Methods taking the name of a
+// bucket that does not exist fail with ErrNotFound.
+type Backend interface {
+	// Create makes an empty bucket, failing with ErrExists if the name is taken
+	Create(name string, metadata Metadata) error
+	// OpenReader reads length bytes of the contents starting at offset. A
+	// negative length reads to the end. The metadata returned describes the
+	// contents being read even if the bucket is replaced while reading.
+	OpenReader(name string, offset int64, length int64) (io.ReadCloser, Metadata, error)
+	// OpenWriter starts replacing the contents of the bucket
+	OpenWriter(name string) (Writer, error)
+	Stat(name string) (Metadata, error)
+	UpdateMetadata(name string, metadata Metadata) error
+	Delete(name string) error
+	// List returns the names of every bucket in sorted order
+	List() ([]string, error)
+	// NamespaceOwner the owner recorded for a namespace, ok is false if it
+	// has never been claimed
+	NamespaceOwner(namespace string) (owner string, ok bool, err error)
+	// ClaimNamespace records the owner of a namespace for good, failing with
+	// ErrExists if it is already claimed
+	ClaimNamespace(namespace string, owner string) error
+}
+
+// SpaceReporter is implemented by backends that can tell how much room is
+// left for new contents. ok is false when the platform cannot tell.
+type SpaceReporter interface {
+	FreeSpace() (free int64, ok bool, err error)
+}
+
+// Writer new contents for a bucket. Readers keep seeing the previous contents
+// until Commit succeeds.
+type Writer interface {
+	io.Writer
+	// Commit replaces the contents of the bucket along with its metadata. It
+	// fails with ErrNotFound if the bucket was deleted since the writer was
+	// opened, even if another has been created under its name.
+	Commit(metadata Metadata) error
+	// Abort discards everything written leaving the bucket unchanged
+	Abort() error
+}
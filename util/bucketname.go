@@ -0,0 +1,97 @@
+package util
+
+import (
+	"crypto/rand"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// BucketNameAlphabet the characters bucket names are generated from
+const BucketNameAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// The characters a chosen bucket name may contain. Each part of a name has to
+// start with a letter or digit.
+const (
+	bucketNameStartCharacters = BucketNameAlphabet + "0123456789"
+	bucketNameCharacters      = bucketNameStartCharacters + "-_"
+)
+
+// BucketNamespaceSeparator separates the namespace of a bucket name, e.g. the
+// team or project in team-a/nightly-build, from the rest of the name
+const BucketNamespaceSeparator = "/"
+
+var ErrInvalidBucketName = errors.New("invalid bucket name")
+
+// BucketName a bucket name that has been checked to be a name, optionally
+// under a namespace, made of letters, digits, - and _. A name cannot hold a
+// dot, a NUL or a path separator other than the one after its namespace so
+// it is always safe to use as a file path. The zero value is not a valid
+// name.
+type BucketName struct {
+	name string
+}
+
+// ParseBucketName checks a bucket name given as a string
+func ParseBucketName(s string) (BucketName, error) {
+	parts := strings.Split(s, BucketNamespaceSeparator)
+	if len(parts) > 2 {
+		return BucketName{}, errors.Wrapf(ErrInvalidBucketName, "%q has more than one namespace", s)
+	}
+	for _, part := range parts {
+		if err := checkBucketNamePart(part); err != nil {
+			return BucketName{}, errors.Wrapf(err, "%q", s)
+		}
+	}
+	return BucketName{name: s}, nil
+}
+
+func checkBucketNamePart(part string) error {
+	if len(part) == 0 || len(part) > MaxBucketNameLength {
+		return errors.Wrapf(ErrInvalidBucketName, "each part must be 1 to %d characters", MaxBucketNameLength)
+	}
+	if strings.IndexByte(bucketNameStartCharacters, part[0]) < 0 {
+		return errors.Wrapf(ErrInvalidBucketName, "%q does not start with a letter or digit", part)
+	}
+	for i := 0; i < len(part); i++ {
+		if strings.IndexByte(bucketNameCharacters, part[i]) < 0 {
+			return errors.Wrapf(ErrInvalidBucketName, "contains %q", part[i])
+		}
+	}
+	return nil
+}
+
+// GenerateBucketName picks a name of length characters from crypto/rand.
+// Random bytes that would favour the start of the alphabet are thrown away
+// so every character is equally likely.
+func GenerateBucketName(length int) (BucketName, error) {
+	if length < MinBucketNameLength || length > MaxBucketNameLength {
+		return BucketName{}, errors.Wrapf(ErrInvalidBucketName, "length %d is not %d to %d", length, MinBucketNameLength, MaxBucketNameLength)
+	}
+	limit := byte(256 / len(BucketNameAlphabet) * len(BucketNameAlphabet))
+	name := make([]byte, 0, length)
+	randomBytes := make([]byte, length)
+	for len(name) < length {
+		if _, err := rand.Read(randomBytes); err != nil {
+			return BucketName{}, errors.Wrap(err, "failed to generate bucket name")
+		}
+		for _, b := range randomBytes {
+			if b < limit && len(name) < length {
+				name = append(name, BucketNameAlphabet[int(b)%len(BucketNameAlphabet)])
+			}
+		}
+	}
+	return BucketName{name: string(name)}, nil
+}
+
+// Namespace the part of the name before the separator or "" if it has none
+func (n BucketName) Namespace() string {
+	if i := strings.Index(n.name, BucketNamespaceSeparator); i >= 0 {
+		return n.name[:i]
+	}
+	return ""
+}
+
+func (n BucketName) String() string {
+	return n.name
+}
@@ -0,0 +1,73 @@
+package util
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestParseBucketName(t *testing.T) {
+	tests := []struct {
+		name      string
+		valid     bool
+		namespace string
+	}{
+		{"foo", true, ""},
+		{"Build_2-x", true, ""},
+		{"0day", true, ""},
+		{"team-a/nightly-build", true, "team-a"},
+		{strings.Repeat("a", MaxBucketNameLength), true, ""},
+		{strings.Repeat("a", MaxBucketNameLength+1), false, ""},
+		{"", false, ""},
+		{"../x", false, ""},
+		{"a/../b", false, ""},
+		{"a/b/c", false, ""},
+		{"/x", false, ""},
+		{"x/", false, ""},
+		{"a\x00b", false, ""},
+		{"a\\b", false, ""},
+		{"foo.meta", false, ""},
+		{".foo", false, ""},
+		{"-foo", false, ""},
+		{"team/_foo", false, ""},
+		{"a b", false, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bucketName, err := ParseBucketName(test.name)
+			if !test.valid {
+				if errors.Cause(err) != ErrInvalidBucketName {
+					t.Fatalf("expected %q to be refused got %v", test.name, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bucketName.String() != test.name || bucketName.Namespace() != test.namespace {
+				t.Fatalf("expected %q in namespace %q got %q in %q", test.name, test.namespace, bucketName, bucketName.Namespace())
+			}
+		})
+	}
+}
+
+func TestGenerateBucketName(t *testing.T) {
+	for _, length := range []int{MinBucketNameLength, DefaultBucketNameLength, MaxBucketNameLength} {
+		bucketName, err := GenerateBucketName(length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bucketName.String()) != length {
+			t.Fatalf("expected %d characters got %q", length, bucketName)
+		}
+		if _, err := ParseBucketName(bucketName.String()); err != nil {
+			t.Fatalf("generated name does not parse. error: %v", err)
+		}
+	}
+	for _, length := range []int{MinBucketNameLength - 1, MaxBucketNameLength + 1} {
+		if _, err := GenerateBucketName(length); errors.Cause(err) != ErrInvalidBucketName {
+			t.Fatalf("expected length %d to be refused got %v", length, err)
+		}
+	}
+}
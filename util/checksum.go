@@ -0,0 +1,50 @@
+package util
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Checksums are sent and stored as "<algorithm>:<hex digest>"
+const (
+	ChecksumSHA256 = "sha256"
+	ChecksumSHA512 = "sha512"
+
+	DefaultChecksumAlgorithm = ChecksumSHA256
+)
+
+var ErrUnknownChecksumAlgorithm = errors.New("unknown checksum algorithm")
+
+// NewChecksumHash returns the hash used for algorithm
+func NewChecksumHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumSHA512:
+		return sha512.New(), nil
+	}
+	return nil, errors.Wrapf(ErrUnknownChecksumAlgorithm, "'%s'", algorithm)
+}
+
+// FormatChecksum the checksum of everything written to h
+func FormatChecksum(algorithm string, h hash.Hash) string {
+	return algorithm + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+// ChecksumAlgorithm returns the algorithm of a checksum made by FormatChecksum
+func ChecksumAlgorithm(checksum string) (string, error) {
+	i := strings.Index(checksum, ":")
+	if i <= 0 || i == len(checksum)-1 {
+		return "", errors.Errorf("malformed checksum '%s'", checksum)
+	}
+	algorithm := checksum[:i]
+	if _, err := NewChecksumHash(algorithm); err != nil {
+		return "", err
+	}
+	return algorithm, nil
+}
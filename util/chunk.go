@@ -0,0 +1,44 @@
+package util
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// An upload of unknown length follows its BucketPutBytesRequest as chunks laid
+// out as
+//
+//	chunk length(4) | chunk
+//
+// ending with a chunk of length 0 and then a BucketPutBytesTrailer.
+
+var ErrChunkTooLarge = errors.New("chunk too large")
+
+// WriteChunk writes p as a single chunk. An empty p ends the upload.
+func WriteChunk(w io.Writer, p []byte) error {
+	if len(p) > MaxUploadChunkSize {
+		return errors.Wrapf(ErrChunkTooLarge, "chunk of %d bytes exceeds %d bytes", len(p), MaxUploadChunkSize)
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(p))); err != nil {
+		return errors.Wrap(err, "failed to write chunk length")
+	}
+	if _, err := w.Write(p); err != nil {
+		return errors.Wrap(err, "failed to write chunk")
+	}
+	return nil
+}
+
+// ReadChunkLength reads the length of the next chunk, leaving the chunk
+// itself to be read from r
+func ReadChunkLength(r io.Reader) (int64, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return 0, errors.Wrap(err, "failed to read chunk length")
+	}
+	if length > MaxUploadChunkSize {
+		return 0, errors.Wrapf(ErrChunkTooLarge, "chunk of %d bytes exceeds %d bytes", length, MaxUploadChunkSize)
+	}
+	return int64(length), nil
+}
@@ -0,0 +1,60 @@
+package util
+
+import "fmt"
+
+// Error codes carried by ErrorResponse and the ErrorCode field of responses
+const (
+	ErrorCodeNone                  int32 = 0
+	ErrorCodeBucketNotFound        int32 = 1
+	ErrorCodeBucketTooSmall        int32 = 2
+	ErrorCodeIOFailure             int32 = 3
+	ErrorCodeForbidden             int32 = 4
+	ErrorCodeUnsupportedVersion    int32 = 5
+	ErrorCodeMalformedMessage      int32 = 6
+	ErrorCodeInternal              int32 = 7
+	ErrorCodeBucketTooLarge        int32 = 8
+	ErrorCodeChecksumMismatch      int32 = 9
+	ErrorCodeUploadSessionNotFound int32 = 10
+	ErrorCodeInvalidRange          int32 = 11
+	ErrorCodeInvalidBucketName     int32 = 12
+	ErrorCodeBucketExists          int32 = 13
+	ErrorCodeBucketExpired         int32 = 14
+	ErrorCodeQuotaExceeded         int32 = 15
+)
+
+var errorCodeText = map[int32]string{
+	ErrorCodeNone:                  "ok",
+	ErrorCodeBucketNotFound:        "bucket not found",
+	ErrorCodeBucketTooSmall:        "bucket too small",
+	ErrorCodeIOFailure:             "server i/o failure",
+	ErrorCodeForbidden:             "forbidden",
+	ErrorCodeUnsupportedVersion:    "unsupported protocol version",
+	ErrorCodeMalformedMessage:      "malformed message",
+	ErrorCodeInternal:              "internal server error",
+	ErrorCodeBucketTooLarge:        "bucket too large",
+	ErrorCodeChecksumMismatch:      "checksum mismatch",
+	ErrorCodeUploadSessionNotFound: "upload session not found",
+	ErrorCodeInvalidRange:          "invalid range",
+	ErrorCodeInvalidBucketName:     "invalid bucket name",
+	ErrorCodeBucketExists:          "bucket already exists",
+	ErrorCodeBucketExpired:         "bucket expired",
+	ErrorCodeQuotaExceeded:         "quota exceeded",
+}
+
+// ErrorCodeText returns a short description of errorCode
+func ErrorCodeText(errorCode int32) string {
+	if text, ok := errorCodeText[errorCode]; ok {
+		return text
+	}
+	return fmt.Sprintf("unknown error code %d", errorCode)
+}
+
+// ErrorCodeRetryable reports whether a request that failed with errorCode
+// may succeed if it is sent again unchanged
+func ErrorCodeRetryable(errorCode int32) bool {
+	switch errorCode {
+	case ErrorCodeIOFailure, ErrorCodeInternal, ErrorCodeChecksumMismatch:
+		return true
+	}
+	return false
+}
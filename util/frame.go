@@ -0,0 +1,114 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Every frame on the wire is laid out as
+//
+//	magic(4) | frame type(1) | payload length(4) | payload crc32(4) | payload
+//
+// with all integers big endian.
+const (
+	FrameMagic        uint32 = 0x4c4f4654 // "LOFT"
+	FrameHeaderLength        = 13
+	MaxFrameSize      uint32 = 1024 * 1024
+)
+
+const (
+	FrameTypeMessage byte = 1
+)
+
+var (
+	ErrBadFrameMagic    = errors.New("bad frame magic")
+	ErrFrameTooLarge    = errors.New("frame too large")
+	ErrFrameChecksum    = errors.New("frame checksum mismatch")
+	ErrUnexpectedFrame  = errors.New("unexpected frame type")
+	ErrTruncatedMessage = errors.New("truncated message")
+)
+
+// WriteFrame writes a single frame holding payload to w
+func WriteFrame(w io.Writer, frameType byte, payload []byte) error {
+	if uint32(len(payload)) > MaxFrameSize {
+		return errors.Wrapf(ErrFrameTooLarge, "frame of %d bytes exceeds %d bytes", len(payload), MaxFrameSize)
+	}
+
+	header := make([]byte, FrameHeaderLength)
+	binary.BigEndian.PutUint32(header[0:4], FrameMagic)
+	header[4] = frameType
+	binary.BigEndian.PutUint32(header[5:9], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[9:13], crc32.ChecksumIEEE(payload))
+
+	if _, err := w.Write(header); err != nil {
+		return errors.Wrap(err, "failed to write frame header")
+	}
+	if _, err := w.Write(payload); err != nil {
+		return errors.Wrap(err, "failed to write frame payload")
+	}
+	return nil
+}
+
+// ReadFrame reads a single frame from r. io.EOF is returned unwrapped when r
+// is closed on a frame boundary.
+func ReadFrame(r io.Reader, maxFrameSize uint32) (byte, []byte, error) {
+	header := make([]byte, FrameHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return 0, nil, err
+		}
+		return 0, nil, errors.Wrap(err, "failed to read frame header")
+	}
+
+	if binary.BigEndian.Uint32(header[0:4]) != FrameMagic {
+		return 0, nil, ErrBadFrameMagic
+	}
+	frameType := header[4]
+	payloadLength := binary.BigEndian.Uint32(header[5:9])
+	if payloadLength > maxFrameSize {
+		return 0, nil, errors.Wrapf(ErrFrameTooLarge, "frame of %d bytes exceeds %d bytes", payloadLength, maxFrameSize)
+	}
+
+	payload := make([]byte, payloadLength)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, errors.Wrap(err, "failed to read frame payload")
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[9:13]) {
+		return 0, nil, ErrFrameChecksum
+	}
+	return frameType, payload, nil
+}
+
+// DecodeMessageFrame deserializes a message frame payload, rejecting any
+// bytes left over after the message
+func DecodeMessageFrame(frameType byte, payload []byte) (interface{}, error) {
+	if frameType != FrameTypeMessage {
+		return nil, errors.Wrapf(ErrUnexpectedFrame, "frame type: %d", frameType)
+	}
+	messageBuffer := bytes.NewBuffer(payload)
+	message, err := DeserializeMessage2(messageBuffer)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrTruncatedMessage
+		}
+		return nil, err
+	}
+	if messageBuffer.Len() > 0 {
+		return nil, errors.Errorf("%d trailing bytes after message", messageBuffer.Len())
+	}
+	return message, nil
+}
+
+// ReadMessageFromReader reads the next message frame from r and deserializes it
+func ReadMessageFromReader(r *bufio.Reader) (interface{}, error) {
+	frameType, payload, err := ReadFrame(r, MaxFrameSize)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeMessageFrame(frameType, payload)
+}
@@ -0,0 +1,94 @@
+package util
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func frameBytes(t testing.TB, frameType byte, payload []byte) []byte {
+	var b bytes.Buffer
+	if err := WriteFrame(&b, frameType, payload); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestReadFrameRejectsCorruption(t *testing.T) {
+	valid := frameBytes(t, FrameTypeMessage, []byte("payload"))
+	tests := []struct {
+		name    string
+		corrupt func([]byte) []byte
+		err     error
+	}{
+		{"bad magic", func(b []byte) []byte { b[0] = 'X'; return b }, ErrBadFrameMagic},
+		{"bad checksum", func(b []byte) []byte { b[len(b)-1] ^= 0xff; return b }, ErrFrameChecksum},
+		{"too large", func(b []byte) []byte { b[5] = 0xff; return b }, ErrFrameTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame := test.corrupt(append([]byte(nil), valid...))
+			_, _, err := ReadFrame(bytes.NewReader(frame), MaxFrameSize)
+			if err == nil || !reflect.DeepEqual(causeOf(err), test.err) {
+				t.Fatalf("expected %v got %v", test.err, err)
+			}
+		})
+	}
+}
+
+// causeOf unwraps errors wrapped by github.com/pkg/errors
+func causeOf(err error) error {
+	for {
+		causer, ok := err.(interface{ Cause() error })
+		if !ok {
+			return err
+		}
+		err = causer.Cause()
+	}
+}
+
+func FuzzReadFrame(f *testing.F) {
+	f.Add(frameBytes(f, FrameTypeMessage, nil))
+	f.Add(frameBytes(f, FrameTypeMessage, []byte("payload")))
+	f.Add([]byte("LOFT"))
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		frameType, payload, err := ReadFrame(bytes.NewReader(data), 4096)
+		if err != nil {
+			return
+		}
+		// a frame that reads back must be written exactly as it was read
+		frame := frameBytes(t, frameType, payload)
+		if !bytes.Equal(frame, data[:len(frame)]) {
+			t.Fatalf("frame %x was read from %x", frame, data)
+		}
+	})
+}
+
+func FuzzDecodeMessageFrame(f *testing.F) {
+	for _, message := range roundTripMessages() {
+		serializedMessage, err := SerializeMessage2(message)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(serializedMessage.Bytes())
+	}
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		message, err := DecodeMessageFrame(FrameTypeMessage, payload)
+		if err != nil {
+			return
+		}
+		// anything that decodes must survive being sent on again
+		serializedMessage, err := SerializeMessage2(message)
+		if err != nil {
+			t.Fatalf("decoded %#v that does not serialize. error: %v", message, err)
+		}
+		decoded, err := DecodeMessageFrame(FrameTypeMessage, serializedMessage.Bytes())
+		if err != nil {
+			t.Fatalf("reserialized %#v does not decode. error: %v", message, err)
+		}
+		if !reflect.DeepEqual(decoded, message) {
+			t.Fatalf("decoded %#v after reserializing %#v", decoded, message)
+		}
+	})
+}
@@ -1,6 +1,35 @@
 package util
 
-const BucketNameLength = 6
+// Generated bucket names are DefaultBucketNameLength characters unless the
+// server is configured otherwise, and no shorter than MinBucketNameLength,
+// the length every name used to have. A name or namespace is at most
+// MaxBucketNameLength characters. Protocol version 1 sends names as exactly
+// BucketNameLengthV1 bytes so it can only carry names that short.
+const (
+	MinBucketNameLength     = 6
+	DefaultBucketNameLength = 16
+	MaxBucketNameLength     = 64
+	BucketNameLengthV1      = MinBucketNameLength
+)
+
+const (
+	ProtocolVersion1 = 1
+	// ProtocolVersion2 adds fields to version 1 messages, which are only on
+	// the wire when the header carries version 2 or later
+	ProtocolVersion2 = 2
+
+	MinProtocolVersion = ProtocolVersion1
+	MaxProtocolVersion = ProtocolVersion2
+)
+
+const (
+	// FeatureCommitAck the server sends a second BucketPutBytesResponse once
+	// the bytes of an upload are safely stored
+	FeatureCommitAck uint32 = 1 << iota
+)
+
+// SupportedFeatures the feature flags this build can advertise in a Hello
+const SupportedFeatures = FeatureCommitAck
 
 const (
 	BucketGenerateMessageType         = 1000
@@ -9,6 +38,42 @@ const (
 	BucketPutBytesResponseMessageType = 1004
 	BucketGetBytesMessageType         = 1002
 	BucketGetBytesResponseMessageType = 1005
+	BucketDeleteMessageType           = 1006
+	BucketDeleteResponseMessageType   = 1007
+	HelloMessageType                  = 1008
+	HelloAckMessageType               = 1009
+	ErrorResponseMessageType          = 1010
+	BucketListMessageType             = 1011
+	BucketListResponseMessageType     = 1012
+	BucketStatMessageType             = 1013
+	BucketStatResponseMessageType     = 1014
+
+	UploadSessionOpenMessageType           = 1015
+	UploadSessionOpenResponseMessageType   = 1016
+	UploadSessionChunkMessageType          = 1017
+	UploadSessionChunkResponseMessageType  = 1018
+	UploadSessionStatusMessageType         = 1019
+	UploadSessionStatusResponseMessageType = 1020
+	UploadSessionCommitMessageType         = 1021
+	UploadSessionCommitResponseMessageType = 1022
+
+	BucketPutBytesTrailerMessageType = 1023
+
+	BucketExtendMessageType         = 1024
+	BucketExtendResponseMessageType = 1025
+)
+
+// MaxUploadChunkSize the most data one UploadSessionChunkRequest or one chunk
+// of an upload of unknown length carries
+const MaxUploadChunkSize = 512 * 1024
+
+// ChunkedUploadLength the NumBytes of a BucketPutBytesRequest whose length is
+// not known up front. Its bytes are sent in chunks, see WriteChunk.
+const ChunkedUploadLength int64 = -1
+
+const (
+	DefaultBucketListPageSize = 100
+	MaxBucketListPageSize     = 1000
 )
 
 type Header struct {
@@ -16,25 +81,48 @@ type Header struct {
 	Version     int32
 }
 
-// BucketGenerateRequest Generate the bucket with a 0 sized file
+// Hello Sent by the client when it connects to advertise the protocol
+// versions and features it supports
+type Hello struct {
+	Header
+	MinVersion int32
+	MaxVersion int32
+	Features   uint32
+}
+
+// HelloAck The protocol version and features the server picked for the connection
+type HelloAck struct {
+	Header
+	ErrorCode       int32
+	SelectedVersion int32
+	Features        uint32
+}
+
+// BucketGenerateRequest Generate the bucket with a 0 sized file. The server
+// picks a name unless Name is set. A bucket with a TimeToLive, in
+// nanoseconds, is deleted once it has expired.
 type BucketGenerateRequest struct {
 	Header
 	NumBytesInBucket int64
+	Name             string
+	TimeToLive       int64
 }
 
 // BucketGenerateResponse The response to bucket geneation
 type BucketGenerateResponse struct {
 	Header
-	ErrorCode                int32
-	UniqueIdentifierNumBytes int64
-	UniqueIdentifier         [BucketNameLength]byte
+	ErrorCode        int32
+	UniqueIdentifier string
 }
 
-// BucketPutBytesRequest Put the users bytes in the bucket
+// BucketPutBytesRequest Put the users bytes in the bucket. Checksum is
+// optional and formatted by FormatChecksum.
 type BucketPutBytesRequest struct {
 	Header
-	UniqueIdentifier [BucketNameLength]byte
+	UniqueIdentifier string
 	NumBytes         int64
+	ContentType      string
+	Checksum         string
 }
 
 // BucketPutBytesResponse
@@ -43,13 +131,169 @@ type BucketPutBytesResponse struct {
 	ErrorCode int32
 }
 
+// BucketPutBytesTrailer Sent after the last chunk of an upload of unknown
+// length. Checksum is optional and must use the algorithm of the request
+// checksum, or DefaultChecksumAlgorithm if the request had none.
+type BucketPutBytesTrailer struct {
+	Header
+	Checksum string
+}
+
+// BucketGetBytesRequest Read Length bytes of the bucket starting at Offset. A
+// negative Offset counts back from the end and a negative Length reads to the
+// end.
 type BucketGetBytesRequest struct {
 	Header
-	UniqueIdentifier [BucketNameLength]byte
+	UniqueIdentifier string
+	Offset           int64
+	Length           int64
 }
 
+// BucketGetBytesResponse Size bytes starting at Offset follow the response.
+// Checksum covers all ContentLength bytes of the bucket and is empty for
+// buckets that have never been uploaded to.
 type BucketGetBytesResponse struct {
+	Header
+	ErrorCode     int32
+	Size          int64
+	Checksum      string
+	Offset        int64
+	ContentLength int64
+}
+
+// BucketDeleteRequest Remove the bucket and its contents
+type BucketDeleteRequest struct {
+	Header
+	UniqueIdentifier string
+}
+
+// BucketDeleteResponse The response to bucket deletion
+type BucketDeleteResponse struct {
+	Header
+	ErrorCode int32
+}
+
+// ErrorResponse Sent in reply to any request the server could not handle
+type ErrorResponse struct {
+	Header
+	ErrorCode int32
+	Message   string
+}
+
+// BucketListRequest List the buckets in name order, MaxResults at a time.
+// PageToken is the NextPageToken of the previous page or empty for the first.
+type BucketListRequest struct {
+	Header
+	PageToken  string
+	MaxResults int32
+}
+
+// BucketInfo Describes a single bucket. Times are unix nanoseconds and
+// ExpiresAt is 0 for buckets that never expire.
+type BucketInfo struct {
+	UniqueIdentifier string
+	Capacity         int64
+	Size             int64
+	CreatedAt        int64
+	ModifiedAt       int64
+	ExpiresAt        int64
+}
+
+// BucketListResponse One page of buckets. NextPageToken is empty on the last page.
+type BucketListResponse struct {
+	Header
+	ErrorCode     int32
+	NextPageToken string
+	Buckets       []BucketInfo
+}
+
+// BucketStatRequest Describe a single bucket without reading its contents
+type BucketStatRequest struct {
+	Header
+	UniqueIdentifier string
+}
+
+// BucketStatResponse The bucket along with its owner and the type and checksum
+// of its contents
+type BucketStatResponse struct {
+	Header
+	ErrorCode   int32
+	Bucket      BucketInfo
+	Owner       string
+	ContentType string
+	Checksum    string
+}
+
+// UploadSessionOpenRequest Start an upload that can be resumed on another
+// connection. Checksum is optional and formatted by FormatChecksum.
+type UploadSessionOpenRequest struct {
+	Header
+	UniqueIdentifier string
+	NumBytes         int64
+	ContentType      string
+	Checksum         string
+}
+
+type UploadSessionOpenResponse struct {
+	Header
+	ErrorCode int32
+	SessionID string
+}
+
+// UploadSessionChunkRequest Data to store at Offset. Data the server already
+// has is skipped so a chunk whose response was lost can be sent again.
+type UploadSessionChunkRequest struct {
+	Header
+	SessionID string
+	Offset    int64
+	Data      []byte
+}
+
+// UploadSessionChunkResponse Offset is where the next chunk starts
+type UploadSessionChunkResponse struct {
+	Header
+	ErrorCode int32
+	Offset    int64
+}
+
+type UploadSessionStatusRequest struct {
+	Header
+	SessionID string
+}
+
+// UploadSessionStatusResponse How many of the NumBytes of the upload the
+// server has stored
+type UploadSessionStatusResponse struct {
+	Header
+	ErrorCode int32
+	Offset    int64
+	NumBytes  int64
+}
+
+// UploadSessionCommitRequest Replace the contents of the bucket once every
+// byte has been sent
+type UploadSessionCommitRequest struct {
+	Header
+	SessionID string
+}
+
+type UploadSessionCommitResponse struct {
+	Header
+	ErrorCode int32
+	Checksum  string
+}
+
+// BucketExtendRequest Expire the bucket TimeToLive nanoseconds from now, or
+// never if TimeToLive is 0. Works on an expired bucket until it is deleted.
+type BucketExtendRequest struct {
+	Header
+	UniqueIdentifier string
+	TimeToLive       int64
+}
+
+// BucketExtendResponse ExpiresAt is in unix nanoseconds, 0 for never
+type BucketExtendResponse struct {
 	Header
 	ErrorCode int32
-	Size      int64
+	ExpiresAt int64
 }
@@ -5,20 +5,25 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"log"
+	"io"
 	"os"
+	"strings"
 
 	"github.com/pkg/errors"
 )
 
 var Verbose bool
 
+// ErrNeedsNewerVersion a message asks for something the protocol version in
+// its header cannot express
+var ErrNeedsNewerVersion = errors.New("needs a newer protocol version")
+
 func VPrintfOut(format string, v ...interface{}) {
 	if Verbose {
 		if len(v) == 0 {
 			fmt.Fprintf(os.Stdout, format)
 		} else {
-			fmt.Fprintf(os.Stdout, format, v)
+			fmt.Fprintf(os.Stdout, format, v...)
 		}
 	}
 }
@@ -28,9 +33,123 @@ func VPrintfErr(format string, v ...interface{}) {
 		if len(v) == 0 {
 			fmt.Fprintf(os.Stderr, format)
 		} else {
-			fmt.Fprintf(os.Stderr, format, v)
+			fmt.Fprintf(os.Stderr, format, v...)
+		}
+	}
+}
+
+// NegotiateProtocolVersion returns the highest protocol version supported by
+// both sides or false if there is none.
+func NegotiateProtocolVersion(minVersion int32, maxVersion int32) (int32, bool) {
+	version := int32(MaxProtocolVersion)
+	if maxVersion < version {
+		version = maxVersion
+	}
+	if version < minVersion || version < MinProtocolVersion {
+		return 0, false
+	}
+	return version, true
+}
+
+// writeIdentifier writes a bucket name as a string from protocol version 2 and
+// as BucketNameLengthV1 bytes padded with NULs before that
+func writeIdentifier(w *bytes.Buffer, version int32, identifier string) error {
+	if version >= ProtocolVersion2 {
+		return writeString(w, identifier)
+	}
+	if len(identifier) > BucketNameLengthV1 {
+		return errors.Wrapf(ErrNeedsNewerVersion, "bucket name %q is longer than %d characters", identifier, BucketNameLengthV1)
+	}
+	var fixed [BucketNameLengthV1]byte
+	copy(fixed[:], identifier)
+	_, err := w.Write(fixed[:])
+	return err
+}
+
+func readIdentifier(r *bytes.Buffer, version int32) (string, error) {
+	if version >= ProtocolVersion2 {
+		return readString(r)
+	}
+	var fixed [BucketNameLengthV1]byte
+	if err := binary.Read(r, binary.BigEndian, &fixed); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(fixed[:]), "\x00"), nil
+}
+
+func writeString(w *bytes.Buffer, s string) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(s))); err != nil {
+		return err
+	}
+	_, err := w.WriteString(s)
+	return err
+}
+
+func readString(r *bytes.Buffer) (string, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+	if int64(length) > int64(r.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+	return string(r.Next(int(length))), nil
+}
+
+func writeBytes(w *bytes.Buffer, b []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(b))); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func readBytes(r *bytes.Buffer) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if int64(length) > int64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, length)
+	copy(b, r.Next(int(length)))
+	return b, nil
+}
+
+// writeBucketInfo ExpiresAt is only sent from protocol version 2
+func writeBucketInfo(w *bytes.Buffer, version int32, info BucketInfo) error {
+	if err := writeString(w, info.UniqueIdentifier); err != nil {
+		return err
+	}
+	fields := []int64{info.Capacity, info.Size, info.CreatedAt, info.ModifiedAt}
+	if version >= ProtocolVersion2 {
+		fields = append(fields, info.ExpiresAt)
+	}
+	for _, v := range fields {
+		if err := binary.Write(w, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readBucketInfo(r *bytes.Buffer, version int32) (BucketInfo, error) {
+	var err error
+	info := BucketInfo{}
+	if info.UniqueIdentifier, err = readString(r); err != nil {
+		return info, err
+	}
+	fields := []*int64{&info.Capacity, &info.Size, &info.CreatedAt, &info.ModifiedAt}
+	if version >= ProtocolVersion2 {
+		fields = append(fields, &info.ExpiresAt)
+	}
+	for _, v := range fields {
+		if err = binary.Read(r, binary.BigEndian, v); err != nil {
+			return info, err
 		}
 	}
+	return info, nil
 }
 
 func DeserializeMessage2(messageBuffer *bytes.Buffer) (interface{}, error) {
@@ -41,12 +160,68 @@ func DeserializeMessage2(messageBuffer *bytes.Buffer) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("message type: %d", header.MessageType)
+	VPrintfErr("message type: %d\n", header.MessageType)
 	err = binary.Read(messageBuffer, binary.BigEndian, &header.Version)
 	if err != nil {
 		return nil, err
 	}
 
+	// the handshake and errors have to be understood before a version is agreed on
+	switch header.MessageType {
+	case HelloMessageType:
+		ret := Hello{Header: header}
+		err = binary.Read(messageBuffer, binary.BigEndian, &ret.MinVersion)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(messageBuffer, binary.BigEndian, &ret.MaxVersion)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(messageBuffer, binary.BigEndian, &ret.Features)
+		if err != nil {
+			return nil, err
+		}
+		return ret, nil
+	case ErrorResponseMessageType:
+		ret := ErrorResponse{Header: header}
+		err = binary.Read(messageBuffer, binary.BigEndian, &ret.ErrorCode)
+		if err != nil {
+			return nil, err
+		}
+		ret.Message, err = readString(messageBuffer)
+		if err != nil {
+			return nil, err
+		}
+		return ret, nil
+	case HelloAckMessageType:
+		ret := HelloAck{Header: header}
+		err = binary.Read(messageBuffer, binary.BigEndian, &ret.ErrorCode)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(messageBuffer, binary.BigEndian, &ret.SelectedVersion)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(messageBuffer, binary.BigEndian, &ret.Features)
+		if err != nil {
+			return nil, err
+		}
+		return ret, nil
+	}
+
+	if header.Version < MinProtocolVersion || header.Version > MaxProtocolVersion {
+		return nil, errors.Errorf("unsupported protocol version %d", header.Version)
+	}
+	return deserializeMessage(header, messageBuffer)
+}
+
+// deserializeMessage decodes every protocol version. Later versions only add
+// fields, which are read when the header version allows them.
+func deserializeMessage(header Header, messageBuffer *bytes.Buffer) (interface{}, error) {
+	var err error
+
 	switch header.MessageType {
 	case BucketGenerateMessageType:
 		ret := BucketGenerateRequest{Header: header}
@@ -54,10 +229,20 @@ func DeserializeMessage2(messageBuffer *bytes.Buffer) (interface{}, error) {
 		if err != nil {
 			return nil, err
 		}
+		if header.Version >= ProtocolVersion2 {
+			ret.Name, err = readString(messageBuffer)
+			if err != nil {
+				return nil, err
+			}
+			err = binary.Read(messageBuffer, binary.BigEndian, &ret.TimeToLive)
+			if err != nil {
+				return nil, err
+			}
+		}
 		return ret, nil
 	case BucketPutBytesMessageType:
 		ret := BucketPutBytesRequest{Header: header}
-		err = binary.Read(messageBuffer, binary.BigEndian, &ret.UniqueIdentifier)
+		ret.UniqueIdentifier, err = readIdentifier(messageBuffer, header.Version)
 		if err != nil {
 			return nil, err
 		}
@@ -65,13 +250,33 @@ func DeserializeMessage2(messageBuffer *bytes.Buffer) (interface{}, error) {
 		if err != nil {
 			return nil, err
 		}
+		if header.Version >= ProtocolVersion2 {
+			ret.ContentType, err = readString(messageBuffer)
+			if err != nil {
+				return nil, err
+			}
+			ret.Checksum, err = readString(messageBuffer)
+			if err != nil {
+				return nil, err
+			}
+		}
 		return ret, nil
 	case BucketGetBytesMessageType:
-		ret := BucketGetBytesRequest{Header: header}
-		err = binary.Read(messageBuffer, binary.BigEndian, &ret.UniqueIdentifier)
+		ret := BucketGetBytesRequest{Header: header, Length: -1}
+		ret.UniqueIdentifier, err = readIdentifier(messageBuffer, header.Version)
 		if err != nil {
 			return nil, err
 		}
+		if header.Version >= ProtocolVersion2 {
+			err = binary.Read(messageBuffer, binary.BigEndian, &ret.Offset)
+			if err != nil {
+				return nil, err
+			}
+			err = binary.Read(messageBuffer, binary.BigEndian, &ret.Length)
+			if err != nil {
+				return nil, err
+			}
+		}
 		return ret, nil
 	case BucketGenerateResponseMessageType:
 		ret := BucketGenerateResponse{Header: header}
@@ -79,11 +284,15 @@ func DeserializeMessage2(messageBuffer *bytes.Buffer) (interface{}, error) {
 		if err != nil {
 			return nil, err
 		}
-		err = binary.Read(messageBuffer, binary.BigEndian, &ret.UniqueIdentifierNumBytes)
-		if err != nil {
-			return nil, err
+		if header.Version < ProtocolVersion2 {
+			// the length of the fixed size identifier that follows
+			var uniqueIdentifierNumBytes int64
+			err = binary.Read(messageBuffer, binary.BigEndian, &uniqueIdentifierNumBytes)
+			if err != nil {
+				return nil, err
+			}
 		}
-		err = binary.Read(messageBuffer, binary.BigEndian, &ret.UniqueIdentifier)
+		ret.UniqueIdentifier, err = readIdentifier(messageBuffer, header.Version)
 		if err != nil {
 			return nil, err
 		}
@@ -105,6 +314,234 @@ func DeserializeMessage2(messageBuffer *bytes.Buffer) (interface{}, error) {
 		if err != nil {
 			return nil, err
 		}
+		// version 1 always sends the whole bucket
+		if header.Version < ProtocolVersion2 {
+			ret.ContentLength = ret.Size
+			return ret, nil
+		}
+		ret.Checksum, err = readString(messageBuffer)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(messageBuffer, binary.BigEndian, &ret.Offset)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(messageBuffer, binary.BigEndian, &ret.ContentLength)
+		if err != nil {
+			return nil, err
+		}
+		return ret, nil
+	case BucketDeleteMessageType:
+		ret := BucketDeleteRequest{Header: header}
+		ret.UniqueIdentifier, err = readIdentifier(messageBuffer, header.Version)
+		if err != nil {
+			return nil, err
+		}
+		return ret, nil
+	case BucketDeleteResponseMessageType:
+		ret := BucketDeleteResponse{Header: header}
+		err = binary.Read(messageBuffer, binary.BigEndian, &ret.ErrorCode)
+		if err != nil {
+			return nil, err
+		}
+		return ret, nil
+	case BucketStatMessageType:
+		ret := BucketStatRequest{Header: header}
+		ret.UniqueIdentifier, err = readIdentifier(messageBuffer, header.Version)
+		if err != nil {
+			return nil, err
+		}
+		return ret, nil
+	case BucketStatResponseMessageType:
+		ret := BucketStatResponse{Header: header}
+		err = binary.Read(messageBuffer, binary.BigEndian, &ret.ErrorCode)
+		if err != nil {
+			return nil, err
+		}
+		ret.Bucket, err = readBucketInfo(messageBuffer, header.Version)
+		if err != nil {
+			return nil, err
+		}
+		ret.Owner, err = readString(messageBuffer)
+		if err != nil {
+			return nil, err
+		}
+		if header.Version >= ProtocolVersion2 {
+			ret.ContentType, err = readString(messageBuffer)
+			if err != nil {
+				return nil, err
+			}
+		}
+		ret.Checksum, err = readString(messageBuffer)
+		if err != nil {
+			return nil, err
+		}
+		return ret, nil
+	case BucketListMessageType:
+		ret := BucketListRequest{Header: header}
+		ret.PageToken, err = readString(messageBuffer)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(messageBuffer, binary.BigEndian, &ret.MaxResults)
+		if err != nil {
+			return nil, err
+		}
+		return ret, nil
+	case BucketListResponseMessageType:
+		ret := BucketListResponse{Header: header}
+		err = binary.Read(messageBuffer, binary.BigEndian, &ret.ErrorCode)
+		if err != nil {
+			return nil, err
+		}
+		ret.NextPageToken, err = readString(messageBuffer)
+		if err != nil {
+			return nil, err
+		}
+		var numBuckets uint32
+		err = binary.Read(messageBuffer, binary.BigEndian, &numBuckets)
+		if err != nil {
+			return nil, err
+		}
+		for i := uint32(0); i < numBuckets; i++ {
+			info, err := readBucketInfo(messageBuffer, header.Version)
+			if err != nil {
+				return nil, err
+			}
+			ret.Buckets = append(ret.Buckets, info)
+		}
+		return ret, nil
+	case BucketPutBytesTrailerMessageType:
+		ret := BucketPutBytesTrailer{Header: header}
+		ret.Checksum, err = readString(messageBuffer)
+		if err != nil {
+			return nil, err
+		}
+		return ret, nil
+	case UploadSessionOpenMessageType:
+		ret := UploadSessionOpenRequest{Header: header}
+		ret.UniqueIdentifier, err = readIdentifier(messageBuffer, header.Version)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(messageBuffer, binary.BigEndian, &ret.NumBytes)
+		if err != nil {
+			return nil, err
+		}
+		ret.ContentType, err = readString(messageBuffer)
+		if err != nil {
+			return nil, err
+		}
+		ret.Checksum, err = readString(messageBuffer)
+		if err != nil {
+			return nil, err
+		}
+		return ret, nil
+	case UploadSessionOpenResponseMessageType:
+		ret := UploadSessionOpenResponse{Header: header}
+		err = binary.Read(messageBuffer, binary.BigEndian, &ret.ErrorCode)
+		if err != nil {
+			return nil, err
+		}
+		ret.SessionID, err = readString(messageBuffer)
+		if err != nil {
+			return nil, err
+		}
+		return ret, nil
+	case UploadSessionChunkMessageType:
+		ret := UploadSessionChunkRequest{Header: header}
+		ret.SessionID, err = readString(messageBuffer)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(messageBuffer, binary.BigEndian, &ret.Offset)
+		if err != nil {
+			return nil, err
+		}
+		ret.Data, err = readBytes(messageBuffer)
+		if err != nil {
+			return nil, err
+		}
+		return ret, nil
+	case UploadSessionChunkResponseMessageType:
+		ret := UploadSessionChunkResponse{Header: header}
+		err = binary.Read(messageBuffer, binary.BigEndian, &ret.ErrorCode)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(messageBuffer, binary.BigEndian, &ret.Offset)
+		if err != nil {
+			return nil, err
+		}
+		return ret, nil
+	case UploadSessionStatusMessageType:
+		ret := UploadSessionStatusRequest{Header: header}
+		ret.SessionID, err = readString(messageBuffer)
+		if err != nil {
+			return nil, err
+		}
+		return ret, nil
+	case UploadSessionStatusResponseMessageType:
+		ret := UploadSessionStatusResponse{Header: header}
+		err = binary.Read(messageBuffer, binary.BigEndian, &ret.ErrorCode)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(messageBuffer, binary.BigEndian, &ret.Offset)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(messageBuffer, binary.BigEndian, &ret.NumBytes)
+		if err != nil {
+			return nil, err
+		}
+		return ret, nil
+	case UploadSessionCommitMessageType:
+		ret := UploadSessionCommitRequest{Header: header}
+		ret.SessionID, err = readString(messageBuffer)
+		if err != nil {
+			return nil, err
+		}
+		return ret, nil
+	case UploadSessionCommitResponseMessageType:
+		ret := UploadSessionCommitResponse{Header: header}
+		err = binary.Read(messageBuffer, binary.BigEndian, &ret.ErrorCode)
+		if err != nil {
+			return nil, err
+		}
+		ret.Checksum, err = readString(messageBuffer)
+		if err != nil {
+			return nil, err
+		}
+		return ret, nil
+	case BucketExtendMessageType:
+		if header.Version < ProtocolVersion2 {
+			return nil, errors.Wrap(ErrNeedsNewerVersion, "extending a bucket")
+		}
+		ret := BucketExtendRequest{Header: header}
+		ret.UniqueIdentifier, err = readString(messageBuffer)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(messageBuffer, binary.BigEndian, &ret.TimeToLive)
+		if err != nil {
+			return nil, err
+		}
+		return ret, nil
+	case BucketExtendResponseMessageType:
+		if header.Version < ProtocolVersion2 {
+			return nil, errors.Wrap(ErrNeedsNewerVersion, "extending a bucket")
+		}
+		ret := BucketExtendResponse{Header: header}
+		err = binary.Read(messageBuffer, binary.BigEndian, &ret.ErrorCode)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Read(messageBuffer, binary.BigEndian, &ret.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
 		return ret, nil
 	}
 	return nil, errors.New("unmapped message type")
@@ -116,22 +553,65 @@ func WriteMessageToWriter(w *bufio.Writer, message interface{}) error {
 	if err != nil {
 		return errors.Wrapf(err, "failed to serialize message")
 	}
-	_, err = w.Write([]byte{byte(serializedMessage.Len())})
-	if err != nil {
-		return errors.Wrapf(err, "failed to write size of message to connection")
-	}
-	_, err = w.Write(serializedMessage.Next(serializedMessage.Len()))
+	err = WriteFrame(w, FrameTypeMessage, serializedMessage.Bytes())
 	if err != nil {
 		return errors.Wrapf(err, "failed to write message to connection")
 	}
-	w.Flush()
-	return nil
+	return w.Flush()
 }
 
 func SerializeMessage2(message interface{}) (*bytes.Buffer, error) {
 	var err error
 	byteBuffer := new(bytes.Buffer)
 	switch v := message.(type) {
+	case ErrorResponse:
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.MessageType); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Version); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.ErrorCode); err != nil {
+			return nil, err
+		}
+		if err = writeString(byteBuffer, v.Message); err != nil {
+			return nil, err
+		}
+		return byteBuffer, nil
+	case Hello:
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.MessageType); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Version); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.MinVersion); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.MaxVersion); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Features); err != nil {
+			return nil, err
+		}
+		return byteBuffer, nil
+	case HelloAck:
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.MessageType); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Version); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.ErrorCode); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.SelectedVersion); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Features); err != nil {
+			return nil, err
+		}
+		return byteBuffer, nil
 	case BucketGenerateRequest:
 		if err = binary.Write(byteBuffer, binary.BigEndian, v.MessageType); err != nil {
 			return nil, err
@@ -142,6 +622,21 @@ func SerializeMessage2(message interface{}) (*bytes.Buffer, error) {
 		if err = binary.Write(byteBuffer, binary.BigEndian, v.NumBytesInBucket); err != nil {
 			return nil, err
 		}
+		if v.Version < ProtocolVersion2 {
+			if v.Name != "" {
+				return nil, errors.Wrap(ErrNeedsNewerVersion, "choosing a bucket name")
+			}
+			if v.TimeToLive != 0 {
+				return nil, errors.Wrap(ErrNeedsNewerVersion, "bucket time to live")
+			}
+			return byteBuffer, nil
+		}
+		if err = writeString(byteBuffer, v.Name); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.TimeToLive); err != nil {
+			return nil, err
+		}
 		return byteBuffer, nil
 	case BucketPutBytesRequest:
 		if err = binary.Write(byteBuffer, binary.BigEndian, v.MessageType); err != nil {
@@ -150,12 +645,20 @@ func SerializeMessage2(message interface{}) (*bytes.Buffer, error) {
 		if err = binary.Write(byteBuffer, binary.BigEndian, v.Version); err != nil {
 			return nil, err
 		}
-		if err = binary.Write(byteBuffer, binary.BigEndian, v.UniqueIdentifier); err != nil {
+		if err = writeIdentifier(byteBuffer, v.Version, v.UniqueIdentifier); err != nil {
 			return nil, err
 		}
 		if err = binary.Write(byteBuffer, binary.BigEndian, v.NumBytes); err != nil {
 			return nil, err
 		}
+		if v.Version >= ProtocolVersion2 {
+			if err = writeString(byteBuffer, v.ContentType); err != nil {
+				return nil, err
+			}
+			if err = writeString(byteBuffer, v.Checksum); err != nil {
+				return nil, err
+			}
+		}
 		return byteBuffer, nil
 	case BucketGetBytesRequest:
 		if err = binary.Write(byteBuffer, binary.BigEndian, v.MessageType); err != nil {
@@ -164,7 +667,19 @@ func SerializeMessage2(message interface{}) (*bytes.Buffer, error) {
 		if err = binary.Write(byteBuffer, binary.BigEndian, v.Version); err != nil {
 			return nil, err
 		}
-		if err = binary.Write(byteBuffer, binary.BigEndian, v.UniqueIdentifier); err != nil {
+		if err = writeIdentifier(byteBuffer, v.Version, v.UniqueIdentifier); err != nil {
+			return nil, err
+		}
+		if v.Version < ProtocolVersion2 {
+			if v.Offset != 0 || v.Length >= 0 {
+				return nil, errors.Wrap(ErrNeedsNewerVersion, "ranged download")
+			}
+			return byteBuffer, nil
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Offset); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Length); err != nil {
 			return nil, err
 		}
 		return byteBuffer, nil
@@ -178,10 +693,12 @@ func SerializeMessage2(message interface{}) (*bytes.Buffer, error) {
 		if err = binary.Write(byteBuffer, binary.BigEndian, v.ErrorCode); err != nil {
 			return nil, err
 		}
-		if err = binary.Write(byteBuffer, binary.BigEndian, v.UniqueIdentifierNumBytes); err != nil {
-			return nil, err
+		if v.Version < ProtocolVersion2 {
+			if err = binary.Write(byteBuffer, binary.BigEndian, int64(BucketNameLengthV1)); err != nil {
+				return nil, err
+			}
 		}
-		if err = binary.Write(byteBuffer, binary.BigEndian, v.UniqueIdentifier); err != nil {
+		if err = writeIdentifier(byteBuffer, v.Version, v.UniqueIdentifier); err != nil {
 			return nil, err
 		}
 		return byteBuffer, nil
@@ -209,6 +726,275 @@ func SerializeMessage2(message interface{}) (*bytes.Buffer, error) {
 		if err = binary.Write(byteBuffer, binary.BigEndian, v.Size); err != nil {
 			return nil, err
 		}
+		if v.Version < ProtocolVersion2 {
+			return byteBuffer, nil
+		}
+		if err = writeString(byteBuffer, v.Checksum); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Offset); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.ContentLength); err != nil {
+			return nil, err
+		}
+		return byteBuffer, nil
+	case BucketDeleteRequest:
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.MessageType); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Version); err != nil {
+			return nil, err
+		}
+		if err = writeIdentifier(byteBuffer, v.Version, v.UniqueIdentifier); err != nil {
+			return nil, err
+		}
+		return byteBuffer, nil
+	case BucketDeleteResponse:
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.MessageType); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Version); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.ErrorCode); err != nil {
+			return nil, err
+		}
+		return byteBuffer, nil
+	case BucketStatRequest:
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.MessageType); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Version); err != nil {
+			return nil, err
+		}
+		if err = writeIdentifier(byteBuffer, v.Version, v.UniqueIdentifier); err != nil {
+			return nil, err
+		}
+		return byteBuffer, nil
+	case BucketStatResponse:
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.MessageType); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Version); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.ErrorCode); err != nil {
+			return nil, err
+		}
+		if err = writeBucketInfo(byteBuffer, v.Version, v.Bucket); err != nil {
+			return nil, err
+		}
+		if err = writeString(byteBuffer, v.Owner); err != nil {
+			return nil, err
+		}
+		if v.Version >= ProtocolVersion2 {
+			if err = writeString(byteBuffer, v.ContentType); err != nil {
+				return nil, err
+			}
+		}
+		if err = writeString(byteBuffer, v.Checksum); err != nil {
+			return nil, err
+		}
+		return byteBuffer, nil
+	case BucketListRequest:
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.MessageType); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Version); err != nil {
+			return nil, err
+		}
+		if err = writeString(byteBuffer, v.PageToken); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.MaxResults); err != nil {
+			return nil, err
+		}
+		return byteBuffer, nil
+	case BucketListResponse:
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.MessageType); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Version); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.ErrorCode); err != nil {
+			return nil, err
+		}
+		if err = writeString(byteBuffer, v.NextPageToken); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, uint32(len(v.Buckets))); err != nil {
+			return nil, err
+		}
+		for _, info := range v.Buckets {
+			if err = writeBucketInfo(byteBuffer, v.Version, info); err != nil {
+				return nil, err
+			}
+		}
+		return byteBuffer, nil
+	case BucketPutBytesTrailer:
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.MessageType); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Version); err != nil {
+			return nil, err
+		}
+		if err = writeString(byteBuffer, v.Checksum); err != nil {
+			return nil, err
+		}
+		return byteBuffer, nil
+	case UploadSessionOpenRequest:
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.MessageType); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Version); err != nil {
+			return nil, err
+		}
+		if err = writeIdentifier(byteBuffer, v.Version, v.UniqueIdentifier); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.NumBytes); err != nil {
+			return nil, err
+		}
+		if err = writeString(byteBuffer, v.ContentType); err != nil {
+			return nil, err
+		}
+		if err = writeString(byteBuffer, v.Checksum); err != nil {
+			return nil, err
+		}
+		return byteBuffer, nil
+	case UploadSessionOpenResponse:
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.MessageType); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Version); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.ErrorCode); err != nil {
+			return nil, err
+		}
+		if err = writeString(byteBuffer, v.SessionID); err != nil {
+			return nil, err
+		}
+		return byteBuffer, nil
+	case UploadSessionChunkRequest:
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.MessageType); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Version); err != nil {
+			return nil, err
+		}
+		if err = writeString(byteBuffer, v.SessionID); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Offset); err != nil {
+			return nil, err
+		}
+		if err = writeBytes(byteBuffer, v.Data); err != nil {
+			return nil, err
+		}
+		return byteBuffer, nil
+	case UploadSessionChunkResponse:
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.MessageType); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Version); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.ErrorCode); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Offset); err != nil {
+			return nil, err
+		}
+		return byteBuffer, nil
+	case UploadSessionStatusRequest:
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.MessageType); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Version); err != nil {
+			return nil, err
+		}
+		if err = writeString(byteBuffer, v.SessionID); err != nil {
+			return nil, err
+		}
+		return byteBuffer, nil
+	case UploadSessionStatusResponse:
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.MessageType); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Version); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.ErrorCode); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Offset); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.NumBytes); err != nil {
+			return nil, err
+		}
+		return byteBuffer, nil
+	case UploadSessionCommitRequest:
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.MessageType); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Version); err != nil {
+			return nil, err
+		}
+		if err = writeString(byteBuffer, v.SessionID); err != nil {
+			return nil, err
+		}
+		return byteBuffer, nil
+	case UploadSessionCommitResponse:
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.MessageType); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Version); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.ErrorCode); err != nil {
+			return nil, err
+		}
+		if err = writeString(byteBuffer, v.Checksum); err != nil {
+			return nil, err
+		}
+		return byteBuffer, nil
+	case BucketExtendRequest:
+		if v.Version < ProtocolVersion2 {
+			return nil, errors.Wrap(ErrNeedsNewerVersion, "extending a bucket")
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.MessageType); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Version); err != nil {
+			return nil, err
+		}
+		if err = writeString(byteBuffer, v.UniqueIdentifier); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.TimeToLive); err != nil {
+			return nil, err
+		}
+		return byteBuffer, nil
+	case BucketExtendResponse:
+		if v.Version < ProtocolVersion2 {
+			return nil, errors.Wrap(ErrNeedsNewerVersion, "extending a bucket")
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.MessageType); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.Version); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.ErrorCode); err != nil {
+			return nil, err
+		}
+		if err = binary.Write(byteBuffer, binary.BigEndian, v.ExpiresAt); err != nil {
+			return nil, err
+		}
 		return byteBuffer, nil
 	}
 	return nil, errors.New("unmapped type to serialize")
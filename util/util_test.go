@@ -0,0 +1,288 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func header(messageType int32) Header {
+	return Header{MessageType: messageType, Version: MaxProtocolVersion}
+}
+
+// roundTripMessages one of every message with every field set
+func roundTripMessages() []interface{} {
+	return []interface{}{
+		Hello{Header: header(HelloMessageType), MinVersion: 1, MaxVersion: 2, Features: FeatureCommitAck},
+		HelloAck{Header: header(HelloAckMessageType), ErrorCode: ErrorCodeUnsupportedVersion, SelectedVersion: 1, Features: FeatureCommitAck},
+		ErrorResponse{Header: header(ErrorResponseMessageType), ErrorCode: ErrorCodeInternal, Message: "failed"},
+		BucketGenerateRequest{Header: header(BucketGenerateMessageType), NumBytesInBucket: 100, Name: "team/build", TimeToLive: 3600},
+		BucketGenerateResponse{Header: header(BucketGenerateResponseMessageType), ErrorCode: ErrorCodeNone, UniqueIdentifier: "abcdef"},
+		BucketPutBytesRequest{Header: header(BucketPutBytesMessageType), UniqueIdentifier: "abcdef", NumBytes: 10,
+			ContentType: "text/plain", Checksum: "sha256:00"},
+		BucketPutBytesResponse{Header: header(BucketPutBytesResponseMessageType), ErrorCode: ErrorCodeBucketTooSmall},
+		BucketPutBytesTrailer{Header: header(BucketPutBytesTrailerMessageType), Checksum: "sha256:00"},
+		BucketGetBytesRequest{Header: header(BucketGetBytesMessageType), UniqueIdentifier: "abcdef", Offset: -10, Length: 5},
+		BucketGetBytesResponse{Header: header(BucketGetBytesResponseMessageType), ErrorCode: ErrorCodeNone, Size: 5,
+			Checksum: "sha256:00", Offset: 90, ContentLength: 100},
+		BucketDeleteRequest{Header: header(BucketDeleteMessageType), UniqueIdentifier: "abcdef"},
+		BucketDeleteResponse{Header: header(BucketDeleteResponseMessageType), ErrorCode: ErrorCodeBucketNotFound},
+		BucketListRequest{Header: header(BucketListMessageType), PageToken: "abcdef", MaxResults: 10},
+		BucketListResponse{Header: header(BucketListResponseMessageType), ErrorCode: ErrorCodeNone, NextPageToken: "ghijkl",
+			Buckets: []BucketInfo{
+				{UniqueIdentifier: "abcdef", Capacity: 100, Size: 10, CreatedAt: 1, ModifiedAt: 2, ExpiresAt: 3},
+				{UniqueIdentifier: "ghijkl", Capacity: 200, Size: 20, CreatedAt: 4, ModifiedAt: 5},
+			}},
+		BucketStatRequest{Header: header(BucketStatMessageType), UniqueIdentifier: "abcdef"},
+		BucketStatResponse{Header: header(BucketStatResponseMessageType), ErrorCode: ErrorCodeNone,
+			Bucket: BucketInfo{UniqueIdentifier: "abcdef", Capacity: 100, Size: 10, CreatedAt: 1, ModifiedAt: 2, ExpiresAt: 3},
+			Owner:  "CN=owner", ContentType: "text/plain", Checksum: "sha256:00"},
+		UploadSessionOpenRequest{Header: header(UploadSessionOpenMessageType), UniqueIdentifier: "abcdef", NumBytes: 10,
+			ContentType: "text/plain", Checksum: "sha256:00"},
+		UploadSessionOpenResponse{Header: header(UploadSessionOpenResponseMessageType), ErrorCode: ErrorCodeNone, SessionID: "session"},
+		UploadSessionChunkRequest{Header: header(UploadSessionChunkMessageType), SessionID: "session", Offset: 5, Data: []byte("chunk")},
+		UploadSessionChunkResponse{Header: header(UploadSessionChunkResponseMessageType), ErrorCode: ErrorCodeNone, Offset: 10},
+		UploadSessionStatusRequest{Header: header(UploadSessionStatusMessageType), SessionID: "session"},
+		UploadSessionStatusResponse{Header: header(UploadSessionStatusResponseMessageType), ErrorCode: ErrorCodeNone, Offset: 5, NumBytes: 10},
+		UploadSessionCommitRequest{Header: header(UploadSessionCommitMessageType), SessionID: "session"},
+		UploadSessionCommitResponse{Header: header(UploadSessionCommitResponseMessageType), ErrorCode: ErrorCodeNone, Checksum: "sha256:00"},
+		BucketExtendRequest{Header: header(BucketExtendMessageType), UniqueIdentifier: "abcdef", TimeToLive: 3600},
+		BucketExtendResponse{Header: header(BucketExtendResponseMessageType), ErrorCode: ErrorCodeNone, ExpiresAt: 3},
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	for _, message := range roundTripMessages() {
+		serializedMessage, err := SerializeMessage2(message)
+		if err != nil {
+			t.Fatalf("failed to serialize %T. error: %v", message, err)
+		}
+		decoded, err := DeserializeMessage2(serializedMessage)
+		if err != nil {
+			t.Fatalf("failed to deserialize %T. error: %v", message, err)
+		}
+		if !reflect.DeepEqual(decoded, message) {
+			t.Fatalf("%T changed in a round trip\nsent:     %#v\nreceived: %#v", message, message, decoded)
+		}
+	}
+}
+
+func TestMessageRoundTripCoversEveryType(t *testing.T) {
+	covered := map[int32]bool{}
+	for _, message := range roundTripMessages() {
+		covered[reflect.ValueOf(message).FieldByName("MessageType").Interface().(int32)] = true
+	}
+	for messageType := int32(BucketGenerateMessageType); messageType <= BucketExtendResponseMessageType; messageType++ {
+		if !covered[messageType] {
+			t.Errorf("no round trip test for message type %d", messageType)
+		}
+	}
+}
+
+func TestMessageFrameRoundTrip(t *testing.T) {
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	messages := roundTripMessages()
+	for _, message := range messages {
+		if err := WriteMessageToWriter(w, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := bufio.NewReader(&b)
+	for _, message := range messages {
+		decoded, err := ReadMessageFromReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, message) {
+			t.Fatalf("%T changed in a round trip\nsent:     %#v\nreceived: %#v", message, message, decoded)
+		}
+	}
+}
+
+// withVersion message with its header version replaced by version
+func withVersion(message interface{}, version int32) interface{} {
+	v := reflect.New(reflect.TypeOf(message)).Elem()
+	v.Set(reflect.ValueOf(message))
+	v.FieldByName("Version").SetInt(int64(version))
+	return v.Interface()
+}
+
+// version1Received how the roundTripMessages carrying fields added after
+// version 1 arrive when sent with a version 1 header
+func version1Received() map[int32]interface{} {
+	v1 := func(messageType int32) Header {
+		return Header{MessageType: messageType, Version: ProtocolVersion1}
+	}
+	return map[int32]interface{}{
+		BucketPutBytesMessageType: BucketPutBytesRequest{Header: v1(BucketPutBytesMessageType), UniqueIdentifier: "abcdef",
+			NumBytes: 10},
+		BucketGetBytesResponseMessageType: BucketGetBytesResponse{Header: v1(BucketGetBytesResponseMessageType),
+			ErrorCode: ErrorCodeNone, Size: 5, ContentLength: 5},
+		BucketListResponseMessageType: BucketListResponse{Header: v1(BucketListResponseMessageType), ErrorCode: ErrorCodeNone,
+			NextPageToken: "ghijkl", Buckets: []BucketInfo{
+				{UniqueIdentifier: "abcdef", Capacity: 100, Size: 10, CreatedAt: 1, ModifiedAt: 2},
+				{UniqueIdentifier: "ghijkl", Capacity: 200, Size: 20, CreatedAt: 4, ModifiedAt: 5},
+			}},
+		BucketStatResponseMessageType: BucketStatResponse{Header: v1(BucketStatResponseMessageType), ErrorCode: ErrorCodeNone,
+			Bucket: BucketInfo{UniqueIdentifier: "abcdef", Capacity: 100, Size: 10, CreatedAt: 1, ModifiedAt: 2},
+			Owner:  "CN=owner", Checksum: "sha256:00"},
+	}
+}
+
+// version1Refused the roundTripMessages that ask for more than version 1 can
+// express
+var version1Refused = map[int32]bool{
+	BucketGenerateMessageType:       true,
+	BucketGetBytesMessageType:       true,
+	BucketExtendMessageType:         true,
+	BucketExtendResponseMessageType: true,
+}
+
+func TestMessageRoundTripVersion1(t *testing.T) {
+	received := version1Received()
+	for _, message := range roundTripMessages() {
+		message = withVersion(message, ProtocolVersion1)
+		messageType := reflect.ValueOf(message).FieldByName("MessageType").Interface().(int32)
+		if version1Refused[messageType] {
+			if _, err := SerializeMessage2(message); errors.Cause(err) != ErrNeedsNewerVersion {
+				t.Fatalf("expected %T to need a newer version got %v", message, err)
+			}
+			continue
+		}
+		expected, ok := received[messageType]
+		if !ok {
+			expected = message
+		}
+		serializedMessage, err := SerializeMessage2(message)
+		if err != nil {
+			t.Fatalf("failed to serialize %T. error: %v", message, err)
+		}
+		decoded, err := DeserializeMessage2(serializedMessage)
+		if err != nil {
+			t.Fatalf("failed to deserialize %T. error: %v", message, err)
+		}
+		if !reflect.DeepEqual(decoded, expected) {
+			t.Fatalf("%T changed in a version 1 round trip\nexpected: %#v\nreceived: %#v", message, expected, decoded)
+		}
+		if serializedMessage.Len() != 0 {
+			t.Fatalf("%T left %d bytes undecoded", message, serializedMessage.Len())
+		}
+	}
+}
+
+func TestUnsupportedVersionRefused(t *testing.T) {
+	for _, version := range []int32{MinProtocolVersion - 1, MaxProtocolVersion + 1} {
+		// the handshake is understood whatever the version
+		hello := Hello{Header: Header{MessageType: HelloMessageType, Version: version}, MinVersion: 1, MaxVersion: 9}
+		serializedMessage, err := SerializeMessage2(hello)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DeserializeMessage2(serializedMessage); err != nil {
+			t.Fatalf("expected a hello at version %d to decode. error: %v", version, err)
+		}
+
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, BucketStatMessageType)
+		binary.Write(&buf, binary.BigEndian, version)
+		writeString(&buf, "abcdef")
+		if _, err := DeserializeMessage2(&buf); err == nil || !strings.Contains(err.Error(), "unsupported protocol version") {
+			t.Fatalf("expected version %d to be refused got %v", version, err)
+		}
+	}
+}
+
+func TestVersion1GetBytesReadsWholeBucket(t *testing.T) {
+	message := BucketGetBytesRequest{
+		Header:           Header{MessageType: BucketGetBytesMessageType, Version: ProtocolVersion1},
+		UniqueIdentifier: "abcdef",
+		Length:           -1,
+	}
+	serializedMessage, err := SerializeMessage2(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DeserializeMessage2(serializedMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, message) {
+		t.Fatalf("expected %#v got %#v", message, decoded)
+	}
+}
+
+func TestVersion1Identifiers(t *testing.T) {
+	v1 := func(messageType int32) Header {
+		return Header{MessageType: messageType, Version: ProtocolVersion1}
+	}
+	tests := []struct {
+		name    string
+		message interface{}
+		wire    []byte
+	}{
+		{"padded", BucketStatRequest{Header: v1(BucketStatMessageType), UniqueIdentifier: "abc"},
+			[]byte("abc\x00\x00\x00")},
+		{"full length", BucketDeleteRequest{Header: v1(BucketDeleteMessageType), UniqueIdentifier: "abcdef"},
+			[]byte("abcdef")},
+		{"generated", BucketGenerateResponse{Header: v1(BucketGenerateResponseMessageType), UniqueIdentifier: "abcdef"},
+			[]byte("\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x06abcdef")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			serializedMessage, err := SerializeMessage2(test.message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// everything after the message type and version
+			if body := serializedMessage.Bytes()[8:]; !bytes.Equal(body, test.wire) {
+				t.Fatalf("expected %q on the wire got %q", test.wire, body)
+			}
+			decoded, err := DeserializeMessage2(serializedMessage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, test.message) {
+				t.Fatalf("expected %#v got %#v", test.message, decoded)
+			}
+		})
+	}
+
+	long := BucketPutBytesRequest{Header: v1(BucketPutBytesMessageType), UniqueIdentifier: "abcdefg"}
+	if _, err := SerializeMessage2(long); errors.Cause(err) != ErrNeedsNewerVersion {
+		t.Fatalf("expected a name longer than %d to need a newer version got %v", BucketNameLengthV1, err)
+	}
+}
+
+func TestVersion1GenerateRequest(t *testing.T) {
+	message := BucketGenerateRequest{
+		Header:           Header{MessageType: BucketGenerateMessageType, Version: ProtocolVersion1},
+		NumBytesInBucket: 100,
+	}
+	serializedMessage, err := SerializeMessage2(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DeserializeMessage2(serializedMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, message) {
+		t.Fatalf("expected %#v got %#v", message, decoded)
+	}
+
+	message.Name = "team/build"
+	if _, err := SerializeMessage2(message); errors.Cause(err) != ErrNeedsNewerVersion {
+		t.Fatalf("expected a named bucket to need a newer version got %v", err)
+	}
+	message.Name = ""
+	message.TimeToLive = 3600
+	if _, err := SerializeMessage2(message); errors.Cause(err) != ErrNeedsNewerVersion {
+		t.Fatalf("expected an expiring bucket to need a newer version got %v", err)
+	}
+}